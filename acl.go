@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+var aclBucket = []byte(`acls`)
+
+const (
+	AccessRead  = "read"
+	AccessWrite = "write"
+)
+
+var (
+	ErrForbiddenKey       = errors.New("Forbidden: You do not have access to this key")
+	ErrBadRule            = errors.New("Access must be either read or write")
+	ErrCannotRestrictRoot = errors.New("Cannot restrict the root user")
+	ErrRuleNotExists      = errors.New("The user has no such rule")
+)
+
+// Rule gives access to all keys starting with Prefix in Namespace, or in every
+// namespace if Namespace is empty. Write access implies read access.
+type Rule struct {
+	Access    string
+	Namespace string `json:",omitempty"`
+	Prefix    string
+}
+
+// ACL is the list of rules for a user. A user without an ACL has access to all
+// keys, whereas a user with an empty ACL has access to none.
+type ACL []Rule
+
+// Allows returns true if any of the rules gives the requested access to the key
+// in the namespace.
+func (acl ACL) Allows(ns, key, access string) bool {
+	for _, rule := range acl {
+		if rule.Namespace != "" && rule.Namespace != ns {
+			continue
+		}
+		if !strings.HasPrefix(key, rule.Prefix) {
+			continue
+		}
+		if rule.Access == AccessWrite || access == AccessRead {
+			return true
+		}
+	}
+	return false
+}
+
+// getACL returns the ACL of the user, and false if the user has none.
+func getACL(tx *bolt.Tx, name string) (ACL, bool, error) {
+	bs := tx.Bucket(aclBucket).Get([]byte(name))
+	if bs == nil {
+		return nil, false, nil
+	}
+	acl := ACL{}
+	if json.Unmarshal(bs, &acl) != nil {
+		return nil, false, ErrDBCorrupted
+	}
+	return acl, true, nil
+}
+
+func putACL(tx *bolt.Tx, name string, acl ACL) error {
+	bs, err := json.Marshal(acl)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(aclBucket).Put([]byte(name), bs)
+}
+
+// ACL returns the ACL of the user, and false if the user has none. Only admins
+// and the user itself can see it.
+func (db DB) ACL(caller *Identity, user string) (acl ACL, restricted bool, err error) {
+	if !caller.IsAdmin() && caller.Name != user {
+		return nil, false, ErrForbiddenRoot
+	}
+	err = db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(userBucket).Get([]byte(user)) == nil {
+			return ErrUserNotExists
+		}
+		acl, restricted, err = getACL(tx, user)
+		return err
+	})
+	return
+}
+
+// Grant adds a rule to the user's ACL, which restricts the user to the rules in
+// it if it wasn't already. Only admins can do this.
+func (db DB) Grant(caller *Identity, user string, rule Rule) error {
+	if !caller.IsAdmin() {
+		return ErrForbiddenRoot
+	}
+	if user == "root" {
+		return ErrCannotRestrictRoot
+	}
+	if rule.Access != AccessRead && rule.Access != AccessWrite {
+		return ErrBadRule
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(userBucket).Get([]byte(user)) == nil {
+			return ErrUserNotExists
+		}
+		acl, _, err := getACL(tx, user)
+		if err != nil {
+			return err
+		}
+		for _, r := range acl {
+			if r == rule {
+				return nil
+			}
+		}
+		return putACL(tx, user, append(acl, rule))
+	})
+}
+
+// Revoke removes a rule from the user's ACL. Only admins can do this.
+func (db DB) Revoke(caller *Identity, user string, rule Rule) error {
+	if !caller.IsAdmin() {
+		return ErrForbiddenRoot
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		acl, _, err := getACL(tx, user)
+		if err != nil {
+			return err
+		}
+		for i, r := range acl {
+			if r == rule {
+				return putACL(tx, user, append(acl[:i], acl[i+1:]...))
+			}
+		}
+		return ErrRuleNotExists
+	})
+}
+
+// ClearACL removes the user's ACL, giving the user access to all keys. Only
+// admins can do this.
+func (db DB) ClearACL(caller *Identity, user string) error {
+	if !caller.IsAdmin() {
+		return ErrForbiddenRoot
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(aclBucket).Delete([]byte(user))
+	})
+}
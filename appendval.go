@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/boltdb/bolt"
+)
+
+var ErrTooLarge = errors.New("The value would exceed the maximum size")
+
+// Append appends data to the value stored under key if the write options are
+// satisfied, and returns the ETag of the new value. A missing key is treated
+// as empty. If maxSize is positive and the new value would be larger than
+// maxSize bytes, ErrTooLarge is returned. The key's TTL is kept, and so is its
+// content type unless opts specifies one.
+func (db DB) Append(namespaceName, key string, data []byte, maxSize int, opts WriteOptions) (etag string, err error) {
+	err = db.Update(func(tx *bolt.Tx) error {
+		ns, err := ensureNamespace(tx, namespaceName)
+		if err != nil {
+			return err
+		}
+		cur := liveValue(ns, []byte(key))
+		if maxSize > 0 && len(cur)+len(data) > maxSize {
+			return ErrTooLarge
+		}
+		val := make([]byte, 0, len(cur)+len(data))
+		val = append(append(val, cur...), data...)
+		opts.KeepTTL = true
+		err = db.putValue(ns, []byte(key), val, opts)
+		if err == nil {
+			etag = ETag(val)
+		}
+		return err
+	})
+	return
+}
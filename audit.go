@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	log "github.com/sirupsen/logrus"
+)
+
+var auditBucket = []byte(`audit`)
+
+// minAuditKeyLength is the minimum length of the audit log key.
+const minAuditKeyLength = 16
+
+var (
+	ErrAuditDisabled = errors.New("The audit log is disabled, so it cannot be verified")
+	ErrShortAuditKey = fmt.Errorf("The audit log key must be at least %d bytes long", minAuditKeyLength)
+)
+
+// AuditEntry is a request recorded in the audit log. Each entry contains the
+// hash of the previous one, so that modifying or removing an entry breaks the
+// chain after it. User is the user the request tried to authenticate as if it
+// failed to, and empty if no user was named.
+type AuditEntry struct {
+	Seq        uint64
+	Time       time.Time
+	User       string
+	RemoteAddr string
+	Method     string
+	Path       string
+	// Namespace and Target are the namespace and the key, user, group or token
+	// the request operated on, if any.
+	Namespace string `json:",omitempty"`
+	Target    string `json:",omitempty"`
+	Status    int
+	Prev      string
+	Hash      string
+}
+
+// hash returns the HMAC of the entry with the key, which covers everything but
+// the hash itself.
+func (e AuditEntry) hash(key []byte) string {
+	e.Hash = ""
+	bs, err := json.Marshal(e)
+	if err != nil {
+		panic(err)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(bs)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// AuditFilter selects the audit entries to return. Zero values match
+// everything.
+type AuditFilter struct {
+	Since time.Time
+	Until time.Time
+	User  string
+	Limit int
+}
+
+func (f AuditFilter) matches(e *AuditEntry) bool {
+	return (f.Since.IsZero() || !e.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || e.Time.Before(f.Until)) &&
+		(f.User == "" || e.User == f.User)
+}
+
+// AuditLog writes audit entries to the database, and to a JSON lines file if
+// File is not nil. The hash chain is keyed with Key, which is kept outside the
+// database, so that the entries cannot be rewritten without the key even by
+// someone who can write to the database. A nil AuditLog records nothing.
+type AuditLog struct {
+	File *os.File
+	Key  []byte
+
+	mu sync.Mutex
+}
+
+// LoadAuditKey reads the audit log key from the file at path. If there is no
+// such file, it is created with a new random key.
+func LoadAuditKey(path string) ([]byte, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err == nil {
+		_, err = fmt.Fprintln(f, hex.EncodeToString(randomBytes(32)))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return nil, err
+		}
+		log.Infof("Created the audit log key %s", path)
+	} else if !os.IsExist(err) {
+		return nil, err
+	}
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key := bytes.TrimSpace(bs)
+	if len(key) < minAuditKeyLength {
+		return nil, ErrShortAuditKey
+	}
+	return key, nil
+}
+
+// auditable returns true if the request should be recorded in the audit log,
+// which is the case for all requests that may change something, backups and
+// user exports.
+func auditable(r *http.Request) bool {
+	return (r.Method != "GET" && r.Method != "HEAD") || r.URL.Path == "/backup" || r.URL.Path == "/users/export"
+}
+
+// auditTarget returns the namespace and the target of a request path.
+func auditTarget(path string) (ns, target string) {
+	if strings.HasPrefix(path, "/ns/") {
+		path = strings.TrimPrefix(path, "/ns/")
+		i := strings.Index(path, "/")
+		if i < 0 {
+			return "", path
+		}
+		ns, path = path[:i], path[i:]
+	}
+	path = strings.TrimPrefix(path, "/")
+	if i := strings.Index(path, "/"); i >= 0 {
+		return ns, path[i+1:]
+	}
+	return ns, ""
+}
+
+// statusRecorder remembers the status code written to a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+// audited calls the handler, and records the request and its outcome in the
+// audit log if it is auditable.
+func (db DB) audited(w http.ResponseWriter, r *http.Request, handler func(w http.ResponseWriter, r *http.Request)) {
+	if db.Audit == nil || !auditable(r) {
+		handler(w, r)
+		return
+	}
+	sr := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	handler(sr, r)
+	db.audit(r, requestIdentity(r).Name, sr.status)
+}
+
+// audit records the request by the user and its response status in the audit
+// log.
+func (db DB) audit(r *http.Request, user string, status int) {
+	e := AuditEntry{
+		Time:       time.Now().UTC(),
+		User:       user,
+		RemoteAddr: r.RemoteAddr,
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		Status:     status,
+	}
+	e.Namespace, e.Target = auditTarget(r.URL.Path)
+	err := db.appendAudit(&e)
+	if err != nil {
+		log.Errorf("Unable to write audit entry for %s %s: %s", e.Method, e.Path, err)
+	}
+}
+
+// appendAudit chains the entry to the last one and stores it.
+func (db DB) appendAudit(e *AuditEntry) error {
+	db.Audit.mu.Lock()
+	defer db.Audit.mu.Unlock()
+	var bs []byte
+	err := db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(auditBucket)
+		if _, last := bucket.Cursor().Last(); last != nil {
+			var prev AuditEntry
+			if json.Unmarshal(last, &prev) != nil {
+				return ErrDBCorrupted
+			}
+			e.Prev = prev.Hash
+		}
+		var err error
+		e.Seq, err = bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		e.Hash = e.hash(db.Audit.Key)
+		bs, err = json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(revisionKey(e.Seq), bs)
+	})
+	if err != nil || db.Audit.File == nil {
+		return err
+	}
+	_, err = db.Audit.File.Write(append(bs, '\n'))
+	return err
+}
+
+// AuditEntries calls fn with every audit entry matching the filter, oldest
+// first. Only root can do this.
+func (db DB) AuditEntries(caller *Identity, f AuditFilter, fn func(e *AuditEntry) error) error {
+	if !caller.IsRoot() {
+		return ErrForbiddenRoot
+	}
+	return db.View(func(tx *bolt.Tx) error {
+		n := 0
+		c := tx.Bucket(auditBucket).Cursor()
+		for k, v := c.First(); k != nil && (f.Limit <= 0 || n < f.Limit); k, v = c.Next() {
+			var e AuditEntry
+			if json.Unmarshal(v, &e) != nil {
+				return ErrDBCorrupted
+			}
+			if !f.matches(&e) {
+				continue
+			}
+			n++
+			err := fn(&e)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// VerifyAudit checks that every audit entry has the right hash and is chained
+// to the previous one, and returns the number of entries. Only root can do
+// this, and only if the audit log is enabled, as its key is needed.
+func (db DB) VerifyAudit(caller *Identity) (n int, err error) {
+	if !caller.IsRoot() {
+		return 0, ErrForbiddenRoot
+	}
+	if db.Audit == nil {
+		return 0, ErrAuditDisabled
+	}
+	err = db.View(func(tx *bolt.Tx) error {
+		prev := ""
+		return tx.Bucket(auditBucket).ForEach(func(k, v []byte) error {
+			var e AuditEntry
+			if json.Unmarshal(v, &e) != nil {
+				return ErrDBCorrupted
+			}
+			if len(k) != 8 || binary.BigEndian.Uint64(k) != e.Seq || e.Prev != prev || !hmac.Equal([]byte(e.hash(db.Audit.Key)), []byte(e.Hash)) {
+				return fmt.Errorf("Audit log tampered with at entry %d", binary.BigEndian.Uint64(k))
+			}
+			prev = e.Hash
+			n++
+			return nil
+		})
+	})
+	return
+}
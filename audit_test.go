@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// auditEntries returns every entry in the audit log.
+func auditEntries(t *testing.T, db DB) (entries []AuditEntry) {
+	err := db.AuditEntries(&Identity{Name: "root"}, AuditFilter{}, func(e *AuditEntry) error {
+		entries = append(entries, *e)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func newAuditedTestDB(t *testing.T) DB {
+	db := newTestDB(t)
+	key, err := LoadAuditKey(filepath.Join(t.TempDir(), "audit-key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Audit = &AuditLog{Key: key}
+	return db
+}
+
+func TestAuditRecordsFailedLogins(t *testing.T) {
+	db := newAuditedTestDB(t)
+	db.Logins = NewLoginTracker(0, 1, time.Minute, false)
+	addTestUser(t, db, "bob")
+	wrong := func(r *http.Request) { r.SetBasicAuth("bob", "wrong password") }
+	statuses := []int{http.StatusUnauthorized, http.StatusTooManyRequests}
+	for _, status := range statuses {
+		if w := serve(db, "PUT", "/val/key", strings.NewReader("value"), wrong); w.Code != status {
+			t.Fatalf("Expected %d, got %d: %s", status, w.Code, w.Body)
+		}
+	}
+	if w := serve(db, "GET", "/val/key", nil, wrong); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429, got %d: %s", w.Code, w.Body)
+	}
+	entries := auditEntries(t, db)
+	if len(entries) != len(statuses) {
+		t.Fatalf("Expected %d audit entries, got %+v", len(statuses), entries)
+	}
+	for i, e := range entries {
+		if e.User != "bob" || e.Method != "PUT" || e.Status != statuses[i] {
+			t.Errorf("Expected a PUT by bob with status %d, got %+v", statuses[i], e)
+		}
+	}
+}
+
+func TestAuditIsRootOnly(t *testing.T) {
+	db := newAuditedTestDB(t)
+	addTestUser(t, db, "admin", RoleAdmin)
+	for _, path := range []string{"/audit", "/audit/verify"} {
+		if w := serve(db, "GET", path, nil, basicAuth("admin")); w.Code != http.StatusForbidden {
+			t.Errorf("GET %s as an admin: expected 403, got %d: %s", path, w.Code, w.Body)
+		}
+	}
+	w := serve(db, "GET", "/audit", nil, basicAuth("root"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /audit as root: expected 200, got %d: %s", w.Code, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Expected the content type application/json, got %q", ct)
+	}
+}
+
+func TestAuditChainIsKeyed(t *testing.T) {
+	db := newAuditedTestDB(t)
+	for _, key := range []string{"a", "b", "c"} {
+		if w := serve(db, "PUT", "/val/"+key, strings.NewReader(key), basicAuth("root")); w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body)
+		}
+	}
+	root := &Identity{Name: "root"}
+	n, err := db.VerifyAudit(root)
+	if err != nil || n != 3 {
+		t.Fatalf("Expected 3 intact entries, got %d (%v)", n, err)
+	}
+
+	// Rewrite the whole chain without the key, hiding the write to b.
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(auditBucket)
+		prev := ""
+		return bucket.ForEach(func(k, v []byte) error {
+			var e AuditEntry
+			if json.Unmarshal(v, &e) != nil {
+				return ErrDBCorrupted
+			}
+			if e.Target == "b" {
+				e.Target = "x"
+			}
+			e.Prev = prev
+			e.Hash = e.hash([]byte("guessed key"))
+			prev = e.Hash
+			bs, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			return bucket.Put(k, bs)
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.VerifyAudit(root); err == nil || err == ErrDBCorrupted {
+		t.Errorf("Expected the rewritten chain to be detected, got %v", err)
+	}
+}
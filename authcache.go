@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// AuthCache remembers successful password checks for a short while, so that
+// clients sending the same credentials on every request don't pay for a bcrypt
+// comparison each time. Only a keyed digest of the credentials is kept, and
+// entries are tied to the user's stored password hash, so changing the password
+// invalidates them. A nil AuthCache caches nothing.
+type AuthCache struct {
+	TTL time.Duration
+
+	key     []byte
+	mu      sync.Mutex
+	entries map[string]authCacheEntry
+}
+
+type authCacheEntry struct {
+	digest  []byte
+	expires time.Time
+}
+
+func NewAuthCache(ttl time.Duration) *AuthCache {
+	return &AuthCache{
+		TTL:     ttl,
+		key:     randomBytes(32),
+		entries: map[string]authCacheEntry{},
+	}
+}
+
+func (ac *AuthCache) digest(name, pass, hashPass string) []byte {
+	mac := hmac.New(sha256.New, ac.key)
+	for _, s := range []string{name, pass, hashPass} {
+		mac.Write([]byte(s))
+		mac.Write([]byte{0})
+	}
+	return mac.Sum(nil)
+}
+
+// Verified returns true if the password was recently verified against the
+// user's password hash.
+func (ac *AuthCache) Verified(name, pass, hashPass string) bool {
+	if ac == nil {
+		return false
+	}
+	digest := ac.digest(name, pass, hashPass)
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	e, ok := ac.entries[name]
+	if !ok {
+		return false
+	}
+	if time.Now().After(e.expires) {
+		delete(ac.entries, name)
+		return false
+	}
+	return hmac.Equal(e.digest, digest)
+}
+
+// Add remembers that the password matches the user's password hash.
+func (ac *AuthCache) Add(name, pass, hashPass string) {
+	if ac == nil {
+		return
+	}
+	digest := ac.digest(name, pass, hashPass)
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	ac.entries[name] = authCacheEntry{digest: digest, expires: time.Now().Add(ac.TTL)}
+}
+
+// Forget removes the cached credentials of the user.
+func (ac *AuthCache) Forget(name string) {
+	if ac == nil {
+		return
+	}
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	delete(ac.entries, name)
+}
+
+// authorizeUser is like AuthorizeUser, but skips the password check if the
+// credentials are in the auth cache.
+func (db DB) authorizeUser(tx *bolt.Tx, name, pass string) (*User, error) {
+	if db.AuthCache != nil {
+		if udata := tx.Bucket(userBucket).Get([]byte(name)); udata != nil {
+			user, err := UnmarshalRawUser(udata)
+			if err == nil && db.AuthCache.Verified(name, pass, user.HashPass) {
+				return user, nil
+			}
+		}
+	}
+	user, err := AuthorizeUser(tx, name, pass)
+	if err == nil {
+		db.AuthCache.Add(name, pass, user.HashPass)
+	}
+	return user, err
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// cached returns true if the auth cache has an entry for the user.
+func cached(ac *AuthCache, name string) bool {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	_, ok := ac.entries[name]
+	return ok
+}
+
+// hashPass returns the stored password hash of the user.
+func hashPass(t *testing.T, db DB, name string) (hash string) {
+	err := db.View(func(tx *bolt.Tx) error {
+		u, err := getUser(tx, name)
+		if err == nil {
+			hash = u.HashPass
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// login authorizes the user with the password the way HttpAuth does.
+func login(db DB, name, pass string) error {
+	return db.View(func(tx *bolt.Tx) error {
+		_, err := db.authorizeUser(tx, name, pass)
+		return err
+	})
+}
+
+func TestAuthCacheSkipsPasswordCheck(t *testing.T) {
+	db := newTestDB(t)
+	db.AuthCache = NewAuthCache(time.Minute)
+	addTestUser(t, db, "bob")
+	if login(db, "bob", "not the password") == nil {
+		t.Fatal("Expected a wrong password to be rejected")
+	}
+	// A cached entry is trusted without comparing the password to the hash, so
+	// this only succeeds if bcrypt is skipped.
+	db.AuthCache.Add("bob", "not the password", hashPass(t, db, "bob"))
+	if err := login(db, "bob", "not the password"); err != nil {
+		t.Fatalf("Expected the cached credentials to be accepted, got %s", err)
+	}
+}
+
+func TestAuthCacheRejectsWrongPassword(t *testing.T) {
+	db := newTestDB(t)
+	db.AuthCache = NewAuthCache(time.Minute)
+	addTestUser(t, db, "bob")
+	if err := login(db, "bob", testPassword); err != nil {
+		t.Fatal(err)
+	}
+	if !cached(db.AuthCache, "bob") {
+		t.Fatal("Expected a successful login to be cached")
+	}
+	if login(db, "bob", "wrong password") == nil {
+		t.Error("Expected a wrong password to be rejected while the right one is cached")
+	}
+	if db.AuthCache.Verified("bob", "wrong password", hashPass(t, db, "bob")) {
+		t.Error("Expected a rejected password not to be cached")
+	}
+	if err := login(db, "bob", testPassword); err != nil {
+		t.Errorf("Expected the right password to still be accepted, got %s", err)
+	}
+}
+
+func TestAuthCacheExpires(t *testing.T) {
+	ac := NewAuthCache(time.Minute)
+	ac.Add("bob", testPassword, "hash")
+	if !ac.Verified("bob", testPassword, "hash") {
+		t.Fatal("Expected the credentials to be cached")
+	}
+	if ac.Verified("bob", testPassword, "other hash") {
+		t.Error("Expected the credentials not to match another password hash")
+	}
+	ac.mu.Lock()
+	ac.entries["bob"] = authCacheEntry{digest: ac.entries["bob"].digest, expires: time.Now().Add(-time.Second)}
+	ac.mu.Unlock()
+	if ac.Verified("bob", testPassword, "hash") {
+		t.Error("Expected the credentials to expire")
+	}
+	if cached(ac, "bob") {
+		t.Error("Expected the expired entry to be removed")
+	}
+}
+
+func TestAuthCacheForgetsChangedUsers(t *testing.T) {
+	root := &Identity{Name: "root", Roles: []string{RoleAdmin}}
+	for _, tc := range []struct {
+		name   string
+		change func(db DB) error
+		status int
+	}{
+		{"password change", func(db DB) error {
+			u := &User{}
+			err := db.Hasher.SetPassword(u, "a new password")
+			if err != nil {
+				return err
+			}
+			return db.PutUser(root, "bob", u)
+		}, http.StatusUnauthorized},
+		{"disable", func(db DB) error {
+			return db.SetDisabled(root, "bob", true)
+		}, http.StatusForbidden},
+		{"delete", func(db DB) error {
+			return db.RmUser(root, "bob")
+		}, http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			db := newTestDB(t)
+			db.AuthCache = NewAuthCache(time.Minute)
+			addTestUser(t, db, "bob")
+			if w := serve(db, "GET", "/val/key", nil, basicAuth("bob")); w.Code != http.StatusNotFound {
+				t.Fatalf("Expected 404, got %d: %s", w.Code, w.Body)
+			}
+			if !cached(db.AuthCache, "bob") {
+				t.Fatal("Expected the login to be cached")
+			}
+			err := tc.change(db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cached(db.AuthCache, "bob") {
+				t.Error("Expected the cached login to be forgotten")
+			}
+			if w := serve(db, "GET", "/val/key", nil, basicAuth("bob")); w.Code != tc.status {
+				t.Errorf("Expected %d, got %d: %s", tc.status, w.Code, w.Body)
+			}
+		})
+	}
+}
+
+// benchmarkGetVal measures GET /val/ with basic auth, with the given auth cache.
+func benchmarkGetVal(b *testing.B, cache *AuthCache) {
+	db := newTestDB(b)
+	db.Hasher = DefaultHasher
+	db.AuthCache = cache
+	addTestUser(b, db, "bob")
+	_, err := db.Put(DefaultNamespace, "key", []byte("value"), WriteOptions{Author: "bob"})
+	if err != nil {
+		b.Fatal(err)
+	}
+	// The first login is never cached, so leave it out of the measurement.
+	if w := serve(db, "GET", "/val/key", nil, basicAuth("bob")); w.Code != http.StatusOK {
+		b.Fatalf("Expected 200, got %d: %s", w.Code, w.Body)
+	}
+	mux := db.ServeMux()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r := httptest.NewRequest("GET", "/val/key", nil)
+		r.SetBasicAuth("bob", testPassword)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			b.Fatalf("Expected 200, got %d: %s", w.Code, w.Body)
+		}
+	}
+}
+
+// BenchmarkGetVal compares GET /val/ with and without the auth cache, which
+// skips the password hash comparison for repeated logins.
+func BenchmarkGetVal(b *testing.B) {
+	b.Run("cached", func(b *testing.B) {
+		benchmarkGetVal(b, NewAuthCache(time.Minute))
+	})
+	b.Run("uncached", func(b *testing.B) {
+		benchmarkGetVal(b, nil)
+	})
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+)
+
+// The modes for client certificate authentication. With ClientCertOptional, a
+// verified certificate authenticates requests without other credentials. With
+// ClientCertRequire, every request must have one, and any other credentials
+// must be for the same user. ClientCertBoth requires both a certificate and
+// other credentials for the same user.
+const (
+	ClientCertOptional = "optional"
+	ClientCertRequire  = "require"
+	ClientCertBoth     = "both"
+)
+
+// The certificate fields a client certificate can be mapped to a user by.
+const (
+	CertFieldCN    = "cn"
+	CertFieldDNS   = "dns"
+	CertFieldEmail = "email"
+	CertFieldURI   = "uri"
+)
+
+var (
+	ErrBadClientCertMode  = errors.New("Client certificate mode must be optional, require or both")
+	ErrBadClientCertField = errors.New("Client certificate user field must be cn, dns, email or uri")
+	ErrNoClientCAs        = errors.New("No certificates found in the client CA file")
+)
+
+// ClientCertAuth authenticates requests by their verified TLS client
+// certificate, mapping the certificate's subject common name or its first
+// subject alternative name of some type to a user. A nil ClientCertAuth
+// authenticates nothing.
+type ClientCertAuth struct {
+	Mode  string
+	Field string
+}
+
+func NewClientCertAuth(mode, field string) (*ClientCertAuth, error) {
+	switch mode {
+	case ClientCertOptional, ClientCertRequire, ClientCertBoth:
+	default:
+		return nil, ErrBadClientCertMode
+	}
+	switch field {
+	case CertFieldCN, CertFieldDNS, CertFieldEmail, CertFieldURI:
+	default:
+		return nil, ErrBadClientCertField
+	}
+	return &ClientCertAuth{Mode: mode, Field: field}, nil
+}
+
+// TLSConfig returns a TLS configuration that verifies client certificates
+// against the CA certificates in the PEM file caFile.
+func (cca *ClientCertAuth) TLSConfig(caFile string) (*tls.Config, error) {
+	bs, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bs) {
+		return nil, ErrNoClientCAs
+	}
+	clientAuth := tls.VerifyClientCertIfGiven
+	if cca.Mode != ClientCertOptional {
+		clientAuth = tls.RequireAndVerifyClientCert
+	}
+	return &tls.Config{ClientCAs: pool, ClientAuth: clientAuth}, nil
+}
+
+// User returns the user the request's verified client certificate maps to, if
+// any.
+func (cca *ClientCertAuth) User(r *http.Request) (string, bool) {
+	if cca == nil || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return "", false
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	name := ""
+	switch cca.Field {
+	case CertFieldCN:
+		name = cert.Subject.CommonName
+	case CertFieldDNS:
+		if len(cert.DNSNames) > 0 {
+			name = cert.DNSNames[0]
+		}
+	case CertFieldEmail:
+		if len(cert.EmailAddresses) > 0 {
+			name = cert.EmailAddresses[0]
+		}
+	case CertFieldURI:
+		if len(cert.URIs) > 0 {
+			name = cert.URIs[0].String()
+		}
+	}
+	return name, name != ""
+}
+
+// Allows returns true if a request with or without other credentials and a
+// client certificate may attempt to authenticate.
+func (cca *ClientCertAuth) Allows(hasCreds, hasCert bool) bool {
+	switch {
+	case cca == nil:
+		return hasCreds
+	case cca.Mode == ClientCertOptional:
+		return hasCreds || hasCert
+	case cca.Mode == ClientCertRequire:
+		return hasCert
+	}
+	return hasCreds && hasCert
+}
+
+// MustMatch returns true if other credentials must be for the same user as the
+// client certificate.
+func (cca *ClientCertAuth) MustMatch() bool {
+	return cca != nil && cca.Mode != ClientCertOptional
+}
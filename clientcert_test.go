@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA is a certificate authority issuing client certificates in tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "valheap test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+// file writes the CA certificate to a PEM file and returns its path.
+func (ca *testCA) file(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	bs := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+	err := ioutil.WriteFile(path, bs, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// issue returns a client certificate for the common name.
+func (ca *testCA) issue(t *testing.T, cn string) *tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestClientCertModes(t *testing.T) {
+	ca, untrusted := newTestCA(t), newTestCA(t)
+	certs := map[string]*tls.Certificate{
+		"bob":       ca.issue(t, "bob"),
+		"nobody":    ca.issue(t, "nobody"),
+		"disabled":  ca.issue(t, "disabled"),
+		"untrusted": untrusted.issue(t, "bob"),
+	}
+	// status 0 means the TLS handshake must fail.
+	tests := []struct {
+		mode     string
+		cert     string
+		user     string
+		password string
+		status   int
+	}{
+		{ClientCertOptional, "", "", "", http.StatusUnauthorized},
+		{ClientCertOptional, "", "bob", testPassword, http.StatusOK},
+		{ClientCertOptional, "bob", "", "", http.StatusOK},
+		{ClientCertOptional, "bob", "alice", testPassword, http.StatusOK},
+		{ClientCertOptional, "nobody", "", "", http.StatusUnauthorized},
+		{ClientCertOptional, "untrusted", "", "", 0},
+		{ClientCertOptional, "disabled", "", "", http.StatusForbidden},
+
+		{ClientCertRequire, "", "bob", testPassword, 0},
+		{ClientCertRequire, "bob", "", "", http.StatusOK},
+		{ClientCertRequire, "bob", "bob", testPassword, http.StatusOK},
+		{ClientCertRequire, "bob", "alice", testPassword, http.StatusUnauthorized},
+		{ClientCertRequire, "nobody", "", "", http.StatusUnauthorized},
+		{ClientCertRequire, "untrusted", "bob", testPassword, 0},
+		{ClientCertRequire, "disabled", "", "", http.StatusForbidden},
+
+		{ClientCertBoth, "", "bob", testPassword, 0},
+		{ClientCertBoth, "bob", "", "", http.StatusUnauthorized},
+		{ClientCertBoth, "bob", "bob", testPassword, http.StatusOK},
+		{ClientCertBoth, "bob", "bob", "wrong password", http.StatusUnauthorized},
+		{ClientCertBoth, "bob", "alice", testPassword, http.StatusUnauthorized},
+		{ClientCertBoth, "untrusted", "bob", testPassword, 0},
+		{ClientCertBoth, "disabled", "disabled", testPassword, http.StatusForbidden},
+	}
+
+	caFile := ca.file(t)
+	servers := map[string]*httptest.Server{}
+	for _, mode := range []string{ClientCertOptional, ClientCertRequire, ClientCertBoth} {
+		db := newTestDB(t)
+		addTestUser(t, db, "alice")
+		addTestUser(t, db, "bob")
+		addTestUser(t, db, "disabled")
+		root := &Identity{Name: "root", Roles: []string{RoleAdmin}}
+		err := db.SetDisabled(root, "disabled", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Put(DefaultNamespace, "key", []byte("value"), WriteOptions{Author: "root"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.ClientCerts, err = NewClientCertAuth(mode, CertFieldCN)
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := httptest.NewUnstartedServer(db.ServeMux())
+		srv.TLS, err = db.ClientCerts.TLSConfig(caFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+		srv.StartTLS()
+		defer srv.Close()
+		servers[mode] = srv
+	}
+
+	for _, tc := range tests {
+		srv := servers[tc.mode]
+		cert := certs[tc.cert]
+		roots := x509.NewCertPool()
+		roots.AddCert(srv.Certificate())
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs: roots,
+			// Always send the certificate, even if the server doesn't trust
+			// its CA.
+			GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				if cert == nil {
+					return &tls.Certificate{}, nil
+				}
+				return cert, nil
+			},
+		}}}
+		req, err := http.NewRequest("GET", srv.URL+"/val/key", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.user != "" {
+			req.SetBasicAuth(tc.user, tc.password)
+		}
+		resp, err := client.Do(req)
+		switch {
+		case err != nil && tc.status != 0:
+			t.Errorf("%s mode, cert %q, user %q: %s", tc.mode, tc.cert, tc.user, err)
+		case err != nil:
+		case tc.status == 0:
+			resp.Body.Close()
+			t.Errorf("%s mode, cert %q, user %q: expected the handshake to fail, got %d", tc.mode, tc.cert, tc.user, resp.StatusCode)
+		default:
+			resp.Body.Close()
+			if resp.StatusCode != tc.status {
+				t.Errorf("%s mode, cert %q, user %q: expected %d, got %d", tc.mode, tc.cert, tc.user, tc.status, resp.StatusCode)
+			}
+		}
+		client.CloseIdleConnections()
+	}
+}
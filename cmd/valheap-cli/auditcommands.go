@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net/url"
+	"strconv"
+)
+
+func Audit() {
+	q := url.Values{}
+	if since != "" {
+		q.Set("since", since)
+	}
+	if until != "" {
+		q.Set("until", until)
+	}
+	if auditUser != "" {
+		q.Set("user", auditUser)
+	}
+	if limit > 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+	userRequest("GET", "/audit", q)
+}
+
+func VerifyAudit() {
+	userRequest("GET", "/audit/verify", nil)
+}
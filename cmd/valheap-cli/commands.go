@@ -1,12 +1,15 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
+	"time"
 )
 
 func Get(val string) {
@@ -14,7 +17,12 @@ func Get(val string) {
 	if err != nil {
 		panic(err)
 	}
-	u.Path = fmt.Sprintf("%s/val/%s", u.Path, val)
+	u.Path = fmt.Sprintf("%s%s/val/%s", u.Path, nsPath(), val)
+	if version != "" {
+		q := u.Query()
+		q.Set("version", version)
+		u.RawQuery = q.Encode()
+	}
 
 	req, err := http.NewRequest("GET", u.String(), nil)
 	if err != nil {
@@ -42,18 +50,131 @@ func Get(val string) {
 	}
 }
 
+// nsPath returns the path prefix for the namespace given by --namespace, or the
+// configured default namespace if not given.
+func nsPath() string {
+	ns := namespace
+	if ns == "" {
+		ns = cfg.Namespace
+	}
+	if ns == "" || ns == "default" {
+		return ""
+	}
+	return "/ns/" + ns
+}
+
+// setConditions adds the If-Match and If-None-Match headers requested through
+// the --if-match and --create-only options.
+func setConditions(req *http.Request) {
+	if ifMatch != "" {
+		req.Header.Set("If-Match", ifMatch)
+	}
+	if createOnly {
+		req.Header.Set("If-None-Match", "*")
+	}
+}
+
+// head does a HEAD request on the key and exits if the key doesn't exist.
+func head(val string) *http.Response {
+	u, err := url.Parse(cfg.Server)
+	if err != nil {
+		panic(err)
+	}
+	u.Path = fmt.Sprintf("%s%s/val/%s", u.Path, nsPath(), val)
+
+	req, err := http.NewRequest("HEAD", u.String(), nil)
+	if err != nil {
+		panic(err)
+	}
+	req.SetBasicAuth(cfg.Username, string(cfg.Password))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		fmt.Fprintln(os.Stderr, http.StatusText(resp.StatusCode))
+		os.Exit(1)
+	}
+	return resp
+}
+
+func Etag(val string) {
+	resp := head(val)
+	fmt.Println(resp.Header.Get("ETag"))
+}
+
+func TTL(val string) {
+	resp := head(val)
+	ttl := resp.Header.Get("X-Valheap-TTL")
+	if ttl == "" {
+		fmt.Println("No TTL")
+		return
+	}
+	fmt.Printf("%ss (expires %s)\n", ttl, resp.Header.Get("X-Valheap-Expires"))
+}
+
 func Put(val string) {
 	u, err := url.Parse(cfg.Server)
 	if err != nil {
 		panic(err)
 	}
-	u.Path = fmt.Sprintf("%s/val/%s", u.Path, val)
+	u.Path = fmt.Sprintf("%s%s/val/%s", u.Path, nsPath(), val)
+	if ttl != "" {
+		q := u.Query()
+		q.Set("ttl", ttl)
+		u.RawQuery = q.Encode()
+	}
 
 	req, err := http.NewRequest("PUT", u.String(), os.Stdin)
 	if err != nil {
 		panic(err)
 	}
 	req.SetBasicAuth(cfg.Username, string(cfg.Password))
+	setConditions(req)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if resp.StatusCode != 200 {
+		os.Stderr.Write(body)
+		if resp.StatusCode == http.StatusPreconditionFailed {
+			os.Exit(exitPreconditionFailed)
+		}
+		os.Exit(1)
+	}
+}
+
+func Append(val string) {
+	u, err := url.Parse(cfg.Server)
+	if err != nil {
+		panic(err)
+	}
+	u.Path = fmt.Sprintf("%s%s/val/%s", u.Path, nsPath(), val)
+	if maxSize > 0 {
+		q := u.Query()
+		q.Set("max", strconv.Itoa(maxSize))
+		u.RawQuery = q.Encode()
+	}
+
+	req, err := http.NewRequest("POST", u.String(), os.Stdin)
+	if err != nil {
+		panic(err)
+	}
+	req.SetBasicAuth(cfg.Username, string(cfg.Password))
+	setConditions(req)
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
@@ -67,6 +188,9 @@ func Put(val string) {
 	}
 	if resp.StatusCode != 200 {
 		os.Stderr.Write(body)
+		if resp.StatusCode == http.StatusPreconditionFailed {
+			os.Exit(exitPreconditionFailed)
+		}
 		os.Exit(1)
 	}
 }
@@ -76,13 +200,14 @@ func Delete(val string) {
 	if err != nil {
 		panic(err)
 	}
-	u.Path = fmt.Sprintf("%s/val/%s", u.Path, val)
+	u.Path = fmt.Sprintf("%s%s/val/%s", u.Path, nsPath(), val)
 
 	req, err := http.NewRequest("DELETE", u.String(), nil)
 	if err != nil {
 		panic(err)
 	}
 	req.SetBasicAuth(cfg.Username, string(cfg.Password))
+	setConditions(req)
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
@@ -96,6 +221,9 @@ func Delete(val string) {
 	}
 	if resp.StatusCode != 200 {
 		os.Stderr.Write(body)
+		if resp.StatusCode == http.StatusPreconditionFailed {
+			os.Exit(exitPreconditionFailed)
+		}
 		os.Exit(1)
 	}
 	_, err = os.Stdout.Write(body)
@@ -104,16 +232,144 @@ func Delete(val string) {
 	}
 }
 
-func List(val string) {
+func Txn() {
+	u, err := url.Parse(cfg.Server)
+	if err != nil {
+		panic(err)
+	}
+	u.Path = fmt.Sprintf("%s%s/txn", u.Path, nsPath())
+
+	req, err := http.NewRequest("POST", u.String(), os.Stdin)
+	if err != nil {
+		panic(err)
+	}
+	req.SetBasicAuth(cfg.Username, string(cfg.Password))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if resp.StatusCode != 200 {
+		os.Stderr.Write(body)
+		if resp.StatusCode == http.StatusPreconditionFailed {
+			os.Exit(exitPreconditionFailed)
+		}
+		os.Exit(1)
+	}
+	os.Stdout.Write(body)
+}
+
+func Stat(val string) {
 	u, err := url.Parse(cfg.Server)
 	if err != nil {
 		panic(err)
 	}
-	u.Path = fmt.Sprintf("%s/listvals", u.Path)
+	u.Path = fmt.Sprintf("%s%s/meta/%s", u.Path, nsPath(), val)
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		panic(err)
+	}
+	req.SetBasicAuth(cfg.Username, string(cfg.Password))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if resp.StatusCode != 200 {
+		os.Stderr.Write(body)
+		os.Exit(1)
+	}
+
+	var km struct {
+		Key  string
+		Meta *struct {
+			Created     time.Time
+			Modified    time.Time
+			ModifiedBy  string
+			ContentType string
+			Size        int
+		}
+	}
+	err = json.Unmarshal(body, &km)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unexpected response from server: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Key:          %s\n", km.Key)
+	if km.Meta == nil {
+		fmt.Println("(no metadata recorded for this key)")
+		return
+	}
+	fmt.Printf("Size:         %d\n", km.Meta.Size)
+	if km.Meta.ContentType != "" {
+		fmt.Printf("Content-Type: %s\n", km.Meta.ContentType)
+	}
+	fmt.Printf("Created:      %s\n", km.Meta.Created.Format(time.RFC3339))
+	fmt.Printf("Modified:     %s by %s\n", km.Meta.Modified.Format(time.RFC3339), km.Meta.ModifiedBy)
+}
+
+func incr(val string, by int64) {
+	u, err := url.Parse(cfg.Server)
+	if err != nil {
+		panic(err)
+	}
+	u.Path = fmt.Sprintf("%s%s/incr/%s", u.Path, nsPath(), val)
 	q := u.Query()
-	q.Set("prefix", val)
+	q.Set("by", strconv.FormatInt(by, 10))
 	u.RawQuery = q.Encode()
 
+	req, err := http.NewRequest("POST", u.String(), nil)
+	if err != nil {
+		panic(err)
+	}
+	req.SetBasicAuth(cfg.Username, string(cfg.Password))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if resp.StatusCode != 200 {
+		os.Stderr.Write(body)
+		os.Exit(1)
+	}
+	os.Stdout.Write(body)
+}
+
+func Incr(val string) {
+	incr(val, by)
+}
+
+func Decr(val string) {
+	incr(val, -by)
+}
+
+func History(val string) {
+	u, err := url.Parse(cfg.Server)
+	if err != nil {
+		panic(err)
+	}
+	u.Path = fmt.Sprintf("%s%s/history/%s", u.Path, nsPath(), val)
+
 	req, err := http.NewRequest("GET", u.String(), nil)
 	if err != nil {
 		panic(err)
@@ -140,6 +396,76 @@ func List(val string) {
 	}
 }
 
+// listPageSize is the number of keys fetched per request when listing.
+const listPageSize = 1000
+
+// List prints the keys with the given prefix, following pages until there are
+// no more keys or --limit keys have been printed.
+func List(val string) {
+	u, err := url.Parse(cfg.Server)
+	if err != nil {
+		panic(err)
+	}
+	u.Path = fmt.Sprintf("%s%s/listvals", u.Path, nsPath())
+	q := u.Query()
+	q.Set("prefix", val)
+	if long {
+		q.Set("long", "true")
+	}
+	if reverse {
+		q.Set("reverse", "true")
+	}
+
+	remaining := limit
+	for {
+		pageSize := listPageSize
+		if remaining > 0 && remaining < pageSize {
+			pageSize = remaining
+		}
+		q.Set("limit", strconv.Itoa(pageSize))
+		u.RawQuery = q.Encode()
+
+		req, err := http.NewRequest("GET", u.String(), nil)
+		if err != nil {
+			panic(err)
+		}
+		req.SetBasicAuth(cfg.Username, string(cfg.Password))
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if resp.StatusCode != 200 {
+			io.Copy(os.Stderr, resp.Body)
+			os.Exit(1)
+		}
+		_, err = io.Copy(os.Stdout, resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		next := resp.Header.Get("X-Valheap-Next")
+		if next == "" {
+			return
+		}
+		if remaining > 0 {
+			remaining -= pageSize
+			if remaining == 0 {
+				return
+			}
+		}
+		startAfter, err := url.QueryUnescape(next)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unexpected response from server: %s\n", err)
+			os.Exit(1)
+		}
+		q.Set("start_after", startAfter)
+	}
+}
+
 func backup(path string) int {
 	u, err := url.Parse(cfg.Server)
 	if err != nil {
@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -17,16 +18,88 @@ const banner = `%s is a tool to talk to a valheap server easily
 
 The following commands are available:
 
-init       (re)Set up your configuration
-chgwpwd    Change your valheap password
-get        Get a key from valheap and print to stdout
-put        Put/update a key to valheap from stdin
-delete     Deletes a key from valheap
-list       Lists all keys in valheap with the provided prefix
-adduser    Adds a user to valheap (must be root)
-rmuser     Removes a user from valheap (root only)
-listusers  Lists all users in valheap (root only)
-backup     Backups the database to the provided file (root only)
+init        (re)Set up your configuration
+chgwpwd     Change your valheap password
+get         Get a key from valheap and print to stdout
+etag        Prints the ETag of a key in valheap
+ttl         Prints the remaining time to live of a key in valheap
+stat        Prints the metadata of a key in valheap
+put         Put/update a key to valheap from stdin
+append      Appends stdin to a key in valheap
+delete      Deletes a key from valheap
+incr        Increments the integer stored in a key and prints the new value
+decr        Decrements the integer stored in a key and prints the new value
+history     Lists the previous revisions of a key
+txn         Performs a JSON list of operations from stdin atomically
+list        Lists all keys in valheap with the provided prefix
+adduser     Adds a user to valheap (admin only)
+rmuser      Removes a user from valheap (admin only)
+unlock      Clears the failed logins of a user, lifting any lockout (admin only)
+listusers   Lists all users in valheap (admin only)
+importusers Adds the users in an htpasswd file from stdin (root only)
+exportusers Prints all users and their password hashes as JSON lines (root only)
+userinfo    Prints the details of a user
+disableuser Disables a user, preventing it from logging in (admin only)
+enableuser  Enables a disabled user (admin only)
+quota       Prints the quota and usage of a user, or yourself if none is given
+setquota    Sets the key and byte quota of a user (admin only)
+acl         Lists the access rules of a user
+grant       Gives a user read/write access to a key prefix (admin only)
+revoke      Removes an access rule from a user (admin only)
+roles       Lists the roles of a user
+setrole     Sets the comma separated roles of a user (admin only)
+addgroup    Creates or updates a group with the --roles given (admin only)
+rmgroup     Removes a group (admin only)
+listgroups  Lists all groups and their roles (admin only)
+addtogroup  Adds a user to a group (admin only)
+rmfromgroup Removes a user from a group (admin only)
+backup      Backups the database to the provided file (backup-operator or admin)
+addns       Creates a namespace (admin only)
+rmns        Drops a namespace and all its keys (admin only)
+listns      Lists all namespaces (admin only)
+audit       Prints the audit log, or checks it with audit verify (root only)
+token       Creates (create), lists (list) or revokes (revoke ID) API tokens
+
+Admin only commands need the admin role. Root only commands, which read or
+replace password hashes or read the audit log, can only be run by root itself.
+
+put and delete take the options --if-match ETAG, to only do the change if the
+key has not been modified since you read it, and --create-only, to only put a
+key that does not exist. Options must come before the key. If the condition is
+not satisfied, nothing is changed and the exit status is 3. The same applies to
+a txn with a failing precondition. put also takes --ttl DURATION (e.g. 10m),
+after which the key is deleted. get takes --version N to print revision N from
+the key's history instead. put takes --content-type TYPE to store the content
+type of the value. list takes -l to also print the size, modification time and
+last writer of each key, --limit N to only list the first N keys, and --reverse
+to list keys in descending order. adduser takes --description TEXT to describe
+the user. incr and decr take --by N to change the value by N instead of 1.
+append takes --max N to refuse the append if the value would become larger than
+N bytes. importusers only accepts bcrypt hashes, and prints the result of each
+line. It skips existing users unless given --overwrite, and exits with status 1
+if any line was rejected. setquota takes --keys N and --bytes N before the
+user, and removes the limit that is left out.
+
+The roles are admin, backup-operator, reader and writer. Users without any roles
+or groups are writers. setrole, addtogroup and rmfromgroup take the user
+followed by the roles or group.
+
+grant and revoke take a user, read or write, and a prefix, and only apply to the
+namespace given by --namespace, or all namespaces if not given. A user with no
+rules has access to everything, and revoke with only a user restores that.
+
+token create prints a new token, which can be passed to the server as
+"Authorization: Bearer TOKEN" instead of a username and password. It takes
+--description TEXT, --expires DURATION, --readonly to only allow reads, and
+--prefix PREFIX to only allow access to keys with that prefix. Options must come
+after create.
+
+audit prints the audit log as JSON lines, and takes --since TIME, --until TIME,
+--user USER and --limit N to filter it. TIME is either an RFC 3339 time or a
+duration before now, like 24h.
+
+All key commands take --namespace NAME to operate on that namespace instead of
+the default one, which can be configured through init.
 
 The environment variable VALHEAP_CLI_FILE can be set to override the
 default valheap file location, which is $HOME/.valheap-cli.json.
@@ -36,27 +109,127 @@ var knownCommand map[string]func(string)
 
 func init() {
 	knownCommand = map[string]func(string){
-		"init":      Get, // yeah yeah
-		"get":       Get,
-		"put":       Put,
-		"delete":    Delete,
-		"adduser":   AddUser,
-		"rmuser":    RmUser,
-		"chgpwd":    Get, // dummy
-		"list":      List,
-		"listusers": List,
-		"backup":    Backup,
+		"init":        Get, // yeah yeah
+		"get":         Get,
+		"etag":        Etag,
+		"ttl":         TTL,
+		"stat":        Stat,
+		"put":         Put,
+		"append":      Append,
+		"delete":      Delete,
+		"incr":        Incr,
+		"decr":        Decr,
+		"history":     History,
+		"txn":         Get, // dummy
+		"adduser":     AddUser,
+		"rmuser":      RmUser,
+		"unlock":      Unlock,
+		"userinfo":    UserInfo,
+		"disableuser": DisableUser,
+		"enableuser":  EnableUser,
+		"quota":       Get, // dummy
+		"setquota":    SetQuota,
+		"chgpwd":      Get, // dummy
+		"list":        List,
+		"listusers":   List,
+		"importusers": Get, // dummy
+		"exportusers": Get, // dummy
+		"acl":         ShowACL,
+		"grant":       Get, // dummy
+		"revoke":      Get, // dummy
+		"roles":       Roles,
+		"setrole":     Get, // dummy
+		"addgroup":    AddGroup,
+		"rmgroup":     RmGroup,
+		"listgroups":  Get, // dummy
+		"addtogroup":  Get, // dummy
+		"rmfromgroup": Get, // dummy
+		"backup":      Backup,
+		"addns":       AddNamespace,
+		"rmns":        RmNamespace,
+		"listns":      Get, // dummy
+		"token":       Get, // dummy
+		"audit":       Get, // dummy
 	}
 }
 
+// twoArgs are the commands taking two arguments.
+var twoArgs = map[string]func(string, string){
+	"setrole":     SetRole,
+	"addtogroup":  AddToGroup,
+	"rmfromgroup": RmFromGroup,
+}
+
 type Config struct {
-	Server   string
-	Username string
-	Password []byte
+	Server    string
+	Username  string
+	Password  []byte
+	Namespace string `json:",omitempty"`
 }
 
 var cfg Config
 
+// exitPreconditionFailed is the exit status used when a conditional write is
+// rejected by the server.
+const exitPreconditionFailed = 3
+
+var (
+	ifMatch     string
+	createOnly  bool
+	ttl         string
+	version     string
+	namespace   string
+	contentType string
+	long        bool
+	limit       int
+	reverse     bool
+	by          int64
+	maxSize     int
+	groupRoles  string
+	description string
+	maxKeys     int
+	maxBytes    int64
+	overwrite   bool
+
+	tokenExpires  string
+	tokenReadOnly bool
+	tokenPrefix   string
+
+	since     string
+	until     string
+	auditUser string
+)
+
+// parseFlags parses the options given after the command name, and returns the
+// remaining arguments.
+func parseFlags(args []string) []string {
+	fs := flag.NewFlagSet(os.Args[0]+" "+os.Args[1], flag.ExitOnError)
+	fs.StringVar(&ifMatch, "if-match", "", "Only put/delete if the key's ETag matches this one")
+	fs.BoolVar(&createOnly, "create-only", false, "Only put if the key does not already exist")
+	fs.StringVar(&ttl, "ttl", "", "Delete the key after this duration (e.g. 10m or 1h30m)")
+	fs.StringVar(&version, "version", "", "Get this revision from the key's history")
+	fs.StringVar(&namespace, "namespace", "", "The namespace to use instead of the configured one")
+	fs.StringVar(&contentType, "content-type", "", "The content type of the value to put")
+	fs.BoolVar(&long, "l", false, "List keys in the long format")
+	fs.IntVar(&limit, "limit", 0, "The maximum number of keys to list")
+	fs.BoolVar(&reverse, "reverse", false, "List keys in descending order")
+	fs.Int64Var(&by, "by", 1, "The amount to increment or decrement by")
+	fs.IntVar(&maxSize, "max", 0, "The maximum size in bytes of the value after appending")
+	fs.StringVar(&groupRoles, "roles", "", "Comma separated roles to give the group")
+	fs.StringVar(&description, "description", "", "A description of the user or token")
+	fs.IntVar(&maxKeys, "keys", 0, "The maximum number of keys the user can own (0 for no limit)")
+	fs.BoolVar(&overwrite, "overwrite", false, "Replace the passwords of existing users when importing")
+	fs.Int64Var(&maxBytes, "bytes", 0, "The maximum number of bytes the user can own (0 for no limit)")
+	fs.StringVar(&tokenExpires, "expires", "", "Expire the token after this duration (e.g. 720h)")
+	fs.BoolVar(&tokenReadOnly, "readonly", false, "Only allow the token to read keys")
+	fs.StringVar(&tokenPrefix, "prefix", "", "Only allow the token to access keys with this prefix")
+	fs.StringVar(&since, "since", "", "Only print audit entries after this time (RFC 3339, or a duration ago like 24h)")
+	fs.StringVar(&until, "until", "", "Only print audit entries before this time (RFC 3339, or a duration ago like 24h)")
+	fs.StringVar(&auditUser, "user", "", "Only print audit entries by this user")
+	fs.Parse(args)
+	return fs.Args()
+}
+
 func configPath() string {
 	path := os.Getenv("VALHEAP_CLI_FILE")
 	if path == "" {
@@ -116,6 +289,16 @@ func makeInit() {
 		uname = cfg.Username
 	}
 
+	if cfg.Namespace != "" {
+		fmt.Printf("  Old default namespace: %s (just press enter to keep it)\n", cfg.Namespace)
+	}
+	fmt.Print("Enter default namespace (optional): ")
+	scanner.Scan()
+	ns := scanner.Text()
+	if ns == "" {
+		ns = cfg.Namespace
+	}
+
 	fmt.Print("Enter password: ")
 	pass, err := gopass.GetPasswd()
 	if err != nil {
@@ -140,6 +323,8 @@ func makeInit() {
 		fmt.Println("Incorrect username/password, please try again")
 		os.Exit(1)
 	case http.StatusNotFound:
+	case http.StatusForbidden:
+		fmt.Printf("You must change your password, do `%s chgpwd` next\n", os.Args[0])
 	default:
 		fmt.Printf("Unexpected error code from server: %d\n", resp.StatusCode)
 	}
@@ -152,9 +337,10 @@ func makeInit() {
 	}
 
 	newConf := Config{
-		Server:   server,
-		Username: uname,
-		Password: pass,
+		Server:    server,
+		Username:  uname,
+		Password:  pass,
+		Namespace: ns,
 	}
 
 	bs, _ := json.Marshal(newConf)
@@ -180,6 +366,14 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	if os.Args[1] == "token" {
+		if len(os.Args) < 3 {
+			Token("", nil)
+		}
+		Token(os.Args[2], parseFlags(os.Args[3:]))
+		os.Exit(0)
+	}
+	args := parseFlags(os.Args[2:])
 	if os.Args[1] == "chgpwd" {
 		ChgPwd()
 		os.Exit(0)
@@ -188,21 +382,87 @@ func main() {
 		ListUsers()
 		os.Exit(0)
 	}
+	if os.Args[1] == "importusers" {
+		ImportUsers()
+		os.Exit(0)
+	}
+	if os.Args[1] == "exportusers" {
+		ExportUsers()
+		os.Exit(0)
+	}
+	if os.Args[1] == "txn" {
+		Txn()
+		os.Exit(0)
+	}
+	if os.Args[1] == "listns" {
+		ListNamespaces()
+		os.Exit(0)
+	}
+	if os.Args[1] == "listgroups" {
+		ListGroups()
+		os.Exit(0)
+	}
+	if twoArgs[os.Args[1]] != nil {
+		if len(args) != 2 {
+			fmt.Fprintf(os.Stderr, "%s expects exactly 2 arguments\n", os.Args[1])
+			os.Exit(1)
+		}
+		twoArgs[os.Args[1]](args[0], args[1])
+		os.Exit(0)
+	}
+	if os.Args[1] == "grant" || os.Args[1] == "revoke" {
+		switch {
+		case len(args) == 3 && os.Args[1] == "grant":
+			Grant(args[0], args[1], args[2])
+		case len(args) == 3:
+			Revoke(args[0], args[1], args[2])
+		case len(args) == 1 && os.Args[1] == "revoke":
+			Revoke(args[0], "", "")
+		default:
+			fmt.Fprintf(os.Stderr, "%s expects a user, read or write, and a prefix\n", os.Args[1])
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if os.Args[1] == "audit" {
+		switch {
+		case len(args) == 0:
+			Audit()
+		case len(args) == 1 && args[0] == "verify":
+			VerifyAudit()
+		default:
+			fmt.Fprintf(os.Stderr, "%s expects no arguments, or verify\n", os.Args[1])
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if os.Args[1] == "quota" {
+		switch len(args) {
+		case 0:
+			Quota(cfg.Username)
+		case 1:
+			Quota(args[0])
+		default:
+			fmt.Fprintf(os.Stderr, "%s expects 0 or 1 argument\n", os.Args[1])
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 	if os.Args[1] == "list" {
-		if len(os.Args) > 3 {
+		if len(args) > 1 {
 			fmt.Fprintf(os.Stderr, "%s expects 0 or 1 argument in\n", os.Args[1])
 			os.Exit(1)
 		}
 		prefix := ""
-		if len(os.Args) == 3 {
-			prefix = os.Args[2]
+		if len(args) == 1 {
+			prefix = args[0]
 		}
 		List(prefix)
 		os.Exit(0)
 	}
-	if len(os.Args) != 3 {
+	if len(args) != 1 {
 		fmt.Fprintf(os.Stderr, "%s expects exactly 1 argument in\n", os.Args[1])
 		os.Exit(1)
 	}
-	knownCommand[os.Args[1]](os.Args[2])
+	knownCommand[os.Args[1]](args[0])
 }
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+func AddNamespace(ns string) {
+	u, err := url.Parse(cfg.Server)
+	if err != nil {
+		panic(err)
+	}
+	u.Path = fmt.Sprintf("%s/ns/%s", u.Path, ns)
+
+	req, err := http.NewRequest("PUT", u.String(), nil)
+	if err != nil {
+		panic(err)
+	}
+	req.SetBasicAuth(cfg.Username, string(cfg.Password))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if resp.StatusCode != 200 {
+		os.Stderr.Write(body)
+		os.Exit(1)
+	}
+	os.Stdout.Write(body)
+}
+
+func RmNamespace(ns string) {
+	u, err := url.Parse(cfg.Server)
+	if err != nil {
+		panic(err)
+	}
+	u.Path = fmt.Sprintf("%s/ns/%s", u.Path, ns)
+
+	req, err := http.NewRequest("DELETE", u.String(), nil)
+	if err != nil {
+		panic(err)
+	}
+	req.SetBasicAuth(cfg.Username, string(cfg.Password))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if resp.StatusCode != 200 {
+		os.Stderr.Write(body)
+		os.Exit(1)
+	}
+	os.Stdout.Write(body)
+}
+
+func ListNamespaces() {
+	u, err := url.Parse(cfg.Server)
+	if err != nil {
+		panic(err)
+	}
+	u.Path = fmt.Sprintf("%s/namespaces", u.Path)
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		panic(err)
+	}
+	req.SetBasicAuth(cfg.Username, string(cfg.Password))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if resp.StatusCode != 200 {
+		os.Stderr.Write(body)
+		os.Exit(1)
+	}
+	_, err = os.Stdout.Write(body)
+	if err != nil {
+		os.Exit(1)
+	}
+}
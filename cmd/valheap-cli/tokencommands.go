@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+)
+
+func CreateToken() {
+	q := url.Values{}
+	if description != "" {
+		q.Set("description", description)
+	}
+	if tokenExpires != "" {
+		q.Set("expires", tokenExpires)
+	}
+	if tokenReadOnly {
+		q.Set("readonly", "true")
+	}
+	if tokenPrefix != "" {
+		q.Set("prefix", tokenPrefix)
+	}
+	userRequest("POST", "/token", q)
+}
+
+func ListTokens() {
+	userRequest("GET", "/tokens", nil)
+}
+
+func RevokeToken(id string) {
+	userRequest("DELETE", fmt.Sprintf("/token/%s", url.PathEscape(id)), nil)
+}
+
+// Token runs the token subcommand with the remaining arguments.
+func Token(sub string, args []string) {
+	switch {
+	case sub == "create" && len(args) == 0:
+		CreateToken()
+	case sub == "list" && len(args) == 0:
+		ListTokens()
+	case sub == "revoke" && len(args) == 1:
+		RevokeToken(args[0])
+	default:
+		fmt.Fprintln(os.Stderr, "token expects create, list or revoke ID")
+		os.Exit(1)
+	}
+}
@@ -8,12 +8,17 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/howeyc/gopass"
 )
 
 type JsonOutput struct {
-	Password string
+	Password    string
+	Description string `json:",omitempty"`
 }
 
 func AddUser(username string) {
@@ -21,25 +26,123 @@ func AddUser(username string) {
 		ChgPwd()
 		return
 	}
+	_, body := putPassword(username, fmt.Sprintf("Enter password for %s: ", username), description)
+	os.Stdout.Write(body)
+}
+
+// putPassword prompts for a password and sets it as the user's password. If the
+// server rejects the password because of its password policy, the reason is
+// printed and the user is prompted again. It returns the password and the
+// response body.
+func putPassword(username, prompt, desc string) (pass []byte, body []byte) {
+	u, err := url.Parse(cfg.Server)
+	if err != nil {
+		panic(err)
+	}
+	u.Path = fmt.Sprintf("%s/user/%s", u.Path, username)
+
+	for {
+		fmt.Print(prompt)
+		pass, err = gopass.GetPasswd()
+		if err != nil {
+			fmt.Printf("Error reading password: %s\n", err)
+			os.Exit(1)
+		}
+
+		bs, err := json.Marshal(JsonOutput{Password: string(pass), Description: desc})
+		if err != nil {
+			panic(err)
+		}
+
+		req, err := http.NewRequest("PUT", u.String(), bytes.NewBuffer(bs))
+		if err != nil {
+			panic(err)
+		}
+		req.SetBasicAuth(cfg.Username, string(cfg.Password))
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		body, err = ioutil.ReadAll(resp.Body)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if resp.StatusCode == http.StatusBadRequest && resp.Header.Get("X-Valheap-Reason") != "" {
+			fmt.Printf("Password rejected (%s): %s", resp.Header.Get("X-Valheap-Reason"), body)
+			continue
+		}
+		if resp.StatusCode != 200 {
+			os.Stderr.Write(body)
+			os.Exit(1)
+		}
+		return pass, body
+	}
+}
+
+func RmUser(username string) {
 	u, err := url.Parse(cfg.Server)
 	if err != nil {
 		panic(err)
 	}
 	u.Path = fmt.Sprintf("%s/user/%s", u.Path, username)
 
-	fmt.Printf("Enter password for %s: ", username)
-	pass, err := gopass.GetPasswd()
+	req, err := http.NewRequest("DELETE", u.String(), nil)
 	if err != nil {
-		fmt.Printf("Error reading password: %s\n", err)
+		panic(err)
+	}
+	req.SetBasicAuth(cfg.Username, string(cfg.Password))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if resp.StatusCode != 200 {
+		os.Stderr.Write(body)
 		os.Exit(1)
 	}
+	os.Stdout.Write(body)
+}
 
-	bs, err := json.Marshal(JsonOutput{string(pass)})
+func ChgPwd() {
+	pass, body := putPassword(cfg.Username, "Enter new password: ", "")
+
+	path := configPath()
+	err := os.RemoveAll(path)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	cfg.Password = pass
+
+	bs, _ := json.Marshal(cfg)
+
+	err = ioutil.WriteFile(path, bs, 0600)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+	os.Stdout.Write(body)
+}
+
+func ListUsers() {
+	u, err := url.Parse(cfg.Server)
 	if err != nil {
 		panic(err)
 	}
+	u.Path = fmt.Sprintf("%s/listusers", u.Path)
 
-	req, err := http.NewRequest("PUT", u.String(), bytes.NewBuffer(bs))
+	req, err := http.NewRequest("GET", u.String(), nil)
 	if err != nil {
 		panic(err)
 	}
@@ -59,17 +162,25 @@ func AddUser(username string) {
 		os.Stderr.Write(body)
 		os.Exit(1)
 	}
-	os.Stdout.Write(body)
+	_, err = os.Stdout.Write(body)
+	if err != nil {
+		os.Exit(1)
+	}
 }
 
-func RmUser(username string) {
+// ImportUsers sends the htpasswd file on stdin to the server, and prints the
+// result of each line.
+func ImportUsers() {
 	u, err := url.Parse(cfg.Server)
 	if err != nil {
 		panic(err)
 	}
-	u.Path = fmt.Sprintf("%s/user/%s", u.Path, username)
+	u.Path += "/users/import"
+	if overwrite {
+		u.RawQuery = "overwrite=true"
+	}
 
-	req, err := http.NewRequest("DELETE", u.String(), nil)
+	req, err := http.NewRequest("POST", u.String(), os.Stdin)
 	if err != nil {
 		panic(err)
 	}
@@ -90,28 +201,84 @@ func RmUser(username string) {
 		os.Exit(1)
 	}
 	os.Stdout.Write(body)
+	for _, line := range strings.Split(string(body), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) > 2 && fields[2] == "rejected" {
+			os.Exit(1)
+		}
+	}
 }
 
-func ChgPwd() {
+func ExportUsers() {
+	userRequest("GET", "/users/export", nil)
+}
+
+// aclRequest sends a request to the ACL endpoint of the user, with the rule as
+// query parameters if access is nonempty.
+func aclRequest(method, username, access, prefix string) {
 	u, err := url.Parse(cfg.Server)
 	if err != nil {
 		panic(err)
 	}
-	u.Path = fmt.Sprintf("%s/user/%s", u.Path, cfg.Username)
+	u.Path = fmt.Sprintf("%s/user/%s/acl", u.Path, username)
+	if access != "" {
+		q := u.Query()
+		q.Set("access", access)
+		q.Set("prefix", prefix)
+		if namespace != "" {
+			q.Set("namespace", namespace)
+		}
+		u.RawQuery = q.Encode()
+	}
 
-	fmt.Print("Enter new password: ")
-	pass, err := gopass.GetPasswd()
+	req, err := http.NewRequest(method, u.String(), nil)
 	if err != nil {
-		fmt.Printf("Error reading password: %s\n", err)
+		panic(err)
+	}
+	req.SetBasicAuth(cfg.Username, string(cfg.Password))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
+	if resp.StatusCode != 200 {
+		os.Stderr.Write(body)
+		os.Exit(1)
+	}
+	os.Stdout.Write(body)
+}
 
-	bs, err := json.Marshal(JsonOutput{string(pass)})
+func ShowACL(username string) {
+	aclRequest("GET", username, "", "")
+}
+
+func Grant(username, access, prefix string) {
+	aclRequest("POST", username, access, prefix)
+}
+
+// Revoke revokes a rule from the user, or removes all restrictions on the user
+// if access is empty.
+func Revoke(username, access, prefix string) {
+	aclRequest("DELETE", username, access, prefix)
+}
+
+// userRequest sends a request without a body to the path on the server, and
+// prints the response.
+func userRequest(method, path string, query url.Values) {
+	u, err := url.Parse(cfg.Server)
 	if err != nil {
 		panic(err)
 	}
+	u.Path += path
+	u.RawQuery = query.Encode()
 
-	req, err := http.NewRequest("PUT", u.String(), bytes.NewBuffer(bs))
+	req, err := http.NewRequest(method, u.String(), nil)
 	if err != nil {
 		panic(err)
 	}
@@ -131,33 +298,101 @@ func ChgPwd() {
 		os.Stderr.Write(body)
 		os.Exit(1)
 	}
+	os.Stdout.Write(body)
+}
 
-	path := configPath()
-	err = os.RemoveAll(path)
+// roleQuery returns the query parameters for a comma separated list of roles.
+func roleQuery(roles string) url.Values {
+	q := url.Values{}
+	for _, role := range strings.Split(roles, ",") {
+		if role != "" {
+			q.Add("role", role)
+		}
+	}
+	return q
+}
+
+func UserInfo(username string) {
+	u, err := url.Parse(cfg.Server)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		panic(err)
 	}
+	u.Path = fmt.Sprintf("%s/user/%s", u.Path, username)
 
-	cfg.Password = pass
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		panic(err)
+	}
+	req.SetBasicAuth(cfg.Username, string(cfg.Password))
 
-	bs, _ = json.Marshal(cfg)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if resp.StatusCode != 200 {
+		os.Stderr.Write(body)
+		os.Exit(1)
+	}
 
-	err = ioutil.WriteFile(path, bs, 0600)
+	var info struct {
+		Name               string
+		Description        string
+		Created            time.Time
+		LastLogin          time.Time
+		LastFailedLogin    time.Time
+		Disabled           bool
+		MustChangePassword bool
+		Roles              []string
+		Groups             []string
+	}
+	err = json.Unmarshal(body, &info)
 	if err != nil {
-		fmt.Println(err)
+		fmt.Fprintf(os.Stderr, "Unexpected response from server: %s\n", err)
 		os.Exit(1)
 	}
-	os.Exit(0)
-	os.Stdout.Write(body)
+	showTime := func(t time.Time) string {
+		if t.IsZero() {
+			return "unknown"
+		}
+		return t.Local().Format(time.RFC1123)
+	}
+	fmt.Printf("User:              %s\n", info.Name)
+	if info.Description != "" {
+		fmt.Printf("Description:       %s\n", info.Description)
+	}
+	fmt.Printf("Roles:             %s\n", strings.Join(info.Roles, ","))
+	fmt.Printf("Groups:            %s\n", strings.Join(info.Groups, ","))
+	fmt.Printf("Created:           %s\n", showTime(info.Created))
+	fmt.Printf("Last login:        %s\n", showTime(info.LastLogin))
+	fmt.Printf("Last failed login: %s\n", showTime(info.LastFailedLogin))
+	if info.Disabled {
+		fmt.Println("Disabled")
+	}
+	if info.MustChangePassword {
+		fmt.Println("Must change password")
+	}
 }
 
-func ListUsers() {
+func DisableUser(username string) {
+	userRequest("POST", fmt.Sprintf("/user/%s/disable", username), nil)
+}
+
+func EnableUser(username string) {
+	userRequest("POST", fmt.Sprintf("/user/%s/enable", username), nil)
+}
+
+func Quota(username string) {
 	u, err := url.Parse(cfg.Server)
 	if err != nil {
 		panic(err)
 	}
-	u.Path = fmt.Sprintf("%s/listusers", u.Path)
+	u.Path = fmt.Sprintf("%s/user/%s/quota", u.Path, username)
 
 	req, err := http.NewRequest("GET", u.String(), nil)
 	if err != nil {
@@ -179,8 +414,77 @@ func ListUsers() {
 		os.Stderr.Write(body)
 		os.Exit(1)
 	}
-	_, err = os.Stdout.Write(body)
+
+	type usage struct {
+		Keys  int
+		Bytes int64
+	}
+	var info struct {
+		User     string
+		MaxKeys  int
+		MaxBytes int64
+		usage
+		Namespaces map[string]usage
+	}
+	err = json.Unmarshal(body, &info)
 	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unexpected response from server: %s\n", err)
 		os.Exit(1)
 	}
+	showLimit := func(limit int64) string {
+		if limit == 0 {
+			return "unlimited"
+		}
+		return strconv.FormatInt(limit, 10)
+	}
+	fmt.Printf("User:  %s\n", info.User)
+	fmt.Printf("Keys:  %d of %s\n", info.Keys, showLimit(int64(info.MaxKeys)))
+	fmt.Printf("Bytes: %d of %s\n", info.Bytes, showLimit(info.MaxBytes))
+	names := make([]string, 0, len(info.Namespaces))
+	for name := range info.Namespaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("  %s\t%d keys\t%d bytes\n", name, info.Namespaces[name].Keys, info.Namespaces[name].Bytes)
+	}
+}
+
+func SetQuota(username string) {
+	q := url.Values{}
+	q.Set("keys", strconv.Itoa(maxKeys))
+	q.Set("bytes", strconv.FormatInt(maxBytes, 10))
+	userRequest("PUT", fmt.Sprintf("/user/%s/quota", username), q)
+}
+
+func Unlock(username string) {
+	userRequest("POST", fmt.Sprintf("/user/%s/unlock", username), nil)
+}
+
+func Roles(username string) {
+	userRequest("GET", fmt.Sprintf("/user/%s/roles", username), nil)
+}
+
+func SetRole(username, roles string) {
+	userRequest("PUT", fmt.Sprintf("/user/%s/roles", username), roleQuery(roles))
+}
+
+func AddGroup(group string) {
+	userRequest("PUT", fmt.Sprintf("/group/%s", group), roleQuery(groupRoles))
+}
+
+func RmGroup(group string) {
+	userRequest("DELETE", fmt.Sprintf("/group/%s", group), nil)
+}
+
+func ListGroups() {
+	userRequest("GET", "/groups", nil)
+}
+
+func AddToGroup(username, group string) {
+	userRequest("PUT", fmt.Sprintf("/group/%s/member/%s", group, username), nil)
+}
+
+func RmFromGroup(username, group string) {
+	userRequest("DELETE", fmt.Sprintf("/group/%s/member/%s", group, username), nil)
 }
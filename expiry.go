@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+
+	"github.com/boltdb/bolt"
+	log "github.com/sirupsen/logrus"
+)
+
+// reapBatchSize is the maximum number of expired keys removed in a single
+// transaction by the reaper.
+const reapBatchSize = 1000
+
+var expiryBucket = []byte(`expiry`)
+
+// expiryIndexBucket holds the keys that expire ordered by when they expire, so
+// that expired keys can be found without looking at the others. Its keys are
+// the encoded expiry time followed by the key, and its values are empty.
+var expiryIndexBucket = []byte(`expiry-index`)
+
+func expiryIndexKey(expires, key []byte) []byte {
+	return append(append(make([]byte, 0, len(expires)+len(key)), expires...), key...)
+}
+
+func encodeTime(t time.Time) []byte {
+	bs := make([]byte, 8)
+	binary.BigEndian.PutUint64(bs, uint64(t.UnixNano()))
+	return bs
+}
+
+func decodeTime(bs []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(bs)))
+}
+
+// expiresAt returns the time the key expires, or the zero time if it never
+// expires.
+func expiresAt(ns buckets, key []byte) time.Time {
+	bs := ns.Bucket(expiryBucket).Get(key)
+	if len(bs) != 8 {
+		return time.Time{}
+	}
+	return decodeTime(bs)
+}
+
+func isExpired(expires time.Time, now time.Time) bool {
+	return !expires.IsZero() && !now.Before(expires)
+}
+
+// setExpiry sets the key to expire after ttl. If ttl is zero, the key is set to
+// never expire.
+func setExpiry(ns buckets, key []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return clearExpiry(ns, key)
+	}
+	return expireAt(ns, key, time.Now().Add(ttl))
+}
+
+// expireAt sets the key to expire at the given time.
+func expireAt(ns buckets, key []byte, expires time.Time) error {
+	err := clearExpiry(ns, key)
+	if err != nil {
+		return err
+	}
+	bs := encodeTime(expires)
+	err = ns.Bucket(expiryIndexBucket).Put(expiryIndexKey(bs, key), []byte{})
+	if err != nil {
+		return err
+	}
+	return ns.Bucket(expiryBucket).Put(key, bs)
+}
+
+// clearExpiry sets the key to never expire.
+func clearExpiry(ns buckets, key []byte) error {
+	bucket := ns.Bucket(expiryBucket)
+	if bs := bucket.Get(key); len(bs) == 8 {
+		err := ns.Bucket(expiryIndexBucket).Delete(expiryIndexKey(bs, key))
+		if err != nil {
+			return err
+		}
+	}
+	return bucket.Delete(key)
+}
+
+// indexExpiries adds every key with an expiry to the expiry index, if the index
+// is empty. Namespaces created before the index existed need this.
+func indexExpiries(ns buckets) error {
+	index := ns.Bucket(expiryIndexBucket)
+	if k, _ := index.Cursor().First(); k != nil {
+		return nil
+	}
+	return ns.Bucket(expiryBucket).ForEach(func(k, v []byte) error {
+		if len(v) != 8 {
+			return nil
+		}
+		return index.Put(expiryIndexKey(v, k), []byte{})
+	})
+}
+
+// expiredKeys returns up to limit keys in the namespace that have expired by
+// now, the ones that expired first first. If limit is zero, all expired keys
+// are returned.
+func expiredKeys(ns buckets, now time.Time, limit int) [][]byte {
+	var keys [][]byte
+	end := encodeTime(now)
+	c := ns.Bucket(expiryIndexBucket).Cursor()
+	for k, _ := c.First(); k != nil && (limit <= 0 || len(keys) < limit); k, _ = c.Next() {
+		if len(k) < 8 || bytes.Compare(k[:8], end) > 0 {
+			break
+		}
+		keys = append(keys, copyBytes(k[8:]))
+	}
+	return keys
+}
+
+// liveValue returns the value of the key, or nil if it doesn't exist or has
+// expired.
+func liveValue(ns buckets, key []byte) []byte {
+	val := ns.Bucket(valueBucket).Get(key)
+	if val == nil || isExpired(expiresAt(ns, key), time.Now()) {
+		return nil
+	}
+	return val
+}
+
+// purgeExpired deletes up to reapBatchSize expired keys in a single
+// transaction, and returns the number of keys deleted.
+func (db DB) purgeExpired() (n int, err error) {
+	err = db.Update(func(tx *bolt.Tx) error {
+		now := time.Now()
+		return forEachNamespace(tx, func(_ string, ns buckets) error {
+			if n >= reapBatchSize {
+				return nil
+			}
+			expired := expiredKeys(ns, now, reapBatchSize-n)
+			for _, key := range expired {
+				err := removeKey(ns, key)
+				if err != nil {
+					return err
+				}
+			}
+			n += len(expired)
+			return nil
+		})
+	})
+	return
+}
+
+// ReapExpired periodically deletes expired keys from the database. It never
+// returns, and should be run in its own goroutine.
+func (db DB) ReapExpired(interval time.Duration) {
+	for range time.Tick(interval) {
+		total := 0
+		for {
+			n, err := db.purgeExpired()
+			if err != nil {
+				log.Errorf("Unable to purge expired keys: %s", err)
+				break
+			}
+			total += n
+			if n < reapBatchSize {
+				break
+			}
+		}
+		if total > 0 {
+			log.Infof("Purged %d expired keys", total)
+		}
+	}
+}
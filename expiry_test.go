@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// indexSize returns the number of entries in the default namespace's expiry
+// index.
+func indexSize(t *testing.T, db DB) (n int) {
+	err := db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(expiryIndexBucket).Stats().KeyN
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestPurgeExpired(t *testing.T) {
+	db := newTestDB(t)
+	for _, key := range []string{"live", "expired", "forever"} {
+		_, err := db.Put(DefaultNamespace, key, []byte(key), WriteOptions{Author: "root", TTL: time.Hour})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := db.Put(DefaultNamespace, "forever", []byte("forever"), WriteOptions{Author: "root"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		return expireAt(tx, []byte("expired"), time.Now().Add(-time.Second))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := indexSize(t, db); n != 2 {
+		t.Fatalf("Expected 2 keys in the expiry index, got %d", n)
+	}
+
+	n, err := db.purgeExpired()
+	if err != nil || n != 1 {
+		t.Fatalf("Expected 1 key purged, got %d (%v)", n, err)
+	}
+	for key, exists := range map[string]bool{"live": true, "expired": false, "forever": true} {
+		entry, err := db.Get(DefaultNamespace, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (entry != nil) != exists {
+			t.Errorf("Expected key %s to exist: %t, got %v", key, exists, entry)
+		}
+	}
+	if n := indexSize(t, db); n != 1 {
+		t.Errorf("Expected 1 key left in the expiry index, got %d", n)
+	}
+}
+
+func TestIndexExpiriesOfOldDatabases(t *testing.T) {
+	db := newTestDB(t)
+	_, err := db.Put(DefaultNamespace, "key", []byte("value"), WriteOptions{Author: "root", TTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Databases created before the index existed have no index bucket.
+	err = db.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket(expiryIndexBucket)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	EnsureBuckets(db.DB, testPassword, testHasher)
+	if n := indexSize(t, db); n != 1 {
+		t.Fatalf("Expected 1 key in the rebuilt expiry index, got %d", n)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		return expireAt(tx, []byte("key"), time.Now().Add(-time.Second))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := db.purgeExpired(); err != nil || n != 1 {
+		t.Fatalf("Expected 1 key purged, got %d (%v)", n, err)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// The algorithms passwords can be hashed with.
+const (
+	HashBcrypt   = "bcrypt"
+	HashArgon2id = "argon2id"
+)
+
+// The argon2id parameters other than the cost, which is its number of passes.
+const (
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+	argon2KeyLen  = 32
+	argon2SaltLen = 16
+)
+
+var (
+	ErrBadHashAlgo = errors.New("Hash algorithm must be bcrypt or argon2id")
+	ErrBadHashCost = errors.New("Hash cost out of range for the algorithm")
+	ErrBadHash     = errors.New("Malformed password hash")
+)
+
+// Hasher hashes passwords with an algorithm and cost.
+type Hasher struct {
+	Algo string
+	Cost int
+}
+
+// DefaultHasher is the hasher used if none is configured.
+var DefaultHasher = Hasher{Algo: HashBcrypt, Cost: 12}
+
+// NewHasher returns a hasher for the algorithm and cost, where a cost of zero
+// uses the algorithm's default.
+func NewHasher(algo string, cost int) (Hasher, error) {
+	switch algo {
+	case HashBcrypt:
+		if cost == 0 {
+			cost = DefaultHasher.Cost
+		}
+		if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+			return Hasher{}, ErrBadHashCost
+		}
+	case HashArgon2id:
+		if cost == 0 {
+			cost = 3
+		}
+		if cost < 1 || cost > 100 {
+			return Hasher{}, ErrBadHashCost
+		}
+	default:
+		return Hasher{}, ErrBadHashAlgo
+	}
+	return Hasher{Algo: algo, Cost: cost}, nil
+}
+
+func (h Hasher) orDefault() Hasher {
+	if h.Algo == "" {
+		return DefaultHasher
+	}
+	return h
+}
+
+// SetPassword sets the user's password hash to the hash of pass.
+func (h Hasher) SetPassword(u *User, pass string) error {
+	h = h.orDefault()
+	switch h.Algo {
+	case HashBcrypt:
+		bs, err := bcrypt.GenerateFromPassword([]byte(pass), h.Cost)
+		if err != nil {
+			return err
+		}
+		u.HashPass = string(bs)
+	case HashArgon2id:
+		salt := randomBytes(argon2SaltLen)
+		key := argon2.IDKey([]byte(pass), salt, uint32(h.Cost), argon2Memory, argon2Threads, argon2KeyLen)
+		u.HashPass = fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version,
+			argon2Memory, h.Cost, argon2Threads,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+	default:
+		return ErrBadHashAlgo
+	}
+	u.HashAlgo, u.HashCost = h.Algo, h.Cost
+	return nil
+}
+
+// compareArgon2id compares an argon2id hash in the PHC string format with a
+// password.
+func compareArgon2id(hash, pass string) error {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != HashArgon2id {
+		return ErrBadHash
+	}
+	var version int
+	var memory, time uint32
+	var threads uint8
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return ErrBadHash
+	}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads)
+	if err != nil {
+		return ErrBadHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return ErrBadHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return ErrBadHash
+	}
+	other := argon2.IDKey([]byte(pass), salt, time, memory, threads, uint32(len(key)))
+	if subtle.ConstantTimeCompare(key, other) != 1 {
+		return ErrUnauthorized
+	}
+	return nil
+}
+
+// NeedsRehash returns true if the user's password was hashed with another
+// algorithm or cost than the hasher's.
+func (u *User) NeedsRehash(h Hasher) bool {
+	h = h.orDefault()
+	algo, cost := u.HashAlgo, u.HashCost
+	if algo == "" {
+		// Hashed before the algorithm was recorded, which means bcrypt.
+		algo = HashBcrypt
+		cost, _ = bcrypt.Cost([]byte(u.HashPass))
+	}
+	return algo != h.Algo || cost != h.Cost
+}
+
+// rehashPassword hashes the password of a user that just logged in with the
+// current hasher, if it was hashed with other settings. It does nothing if the
+// password was changed in the meantime.
+func (db DB) rehashPassword(name, pass string, u *User) {
+	if !u.NeedsRehash(db.Hasher) {
+		return
+	}
+	var rehashed User
+	err := db.Hasher.SetPassword(&rehashed, pass)
+	if err == nil {
+		err = db.Update(func(tx *bolt.Tx) error {
+			return updateUser(tx, name, func(cur *User) error {
+				if cur.HashPass == u.HashPass {
+					cur.HashPass, cur.HashAlgo, cur.HashCost = rehashed.HashPass, rehashed.HashAlgo, rehashed.HashCost
+				}
+				return nil
+			})
+		})
+	}
+	if err != nil {
+		log.Errorf("Unable to rehash password of %s: %s", name, err)
+		return
+	}
+	log.Infof("Rehashed password of %s with %s (cost %d)", name, rehashed.HashAlgo, rehashed.HashCost)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var historyBucket = []byte(`history`)
+
+var ErrRevisionNotExists = errors.New("Revision does not exist")
+
+// Revision is a previous value of a key, archived when it was overwritten or
+// deleted. Time and Author tell when and by whom that happened.
+type Revision struct {
+	Revision uint64
+	Time     time.Time
+	Author   string
+	Size     int
+	Value    []byte `json:",omitempty"`
+}
+
+func revisionKey(rev uint64) []byte {
+	bs := make([]byte, 8)
+	binary.BigEndian.PutUint64(bs, rev)
+	return bs
+}
+
+// archive stores the previous value of a key in the history bucket, and prunes
+// the oldest revisions if there are more than db.HistoryLimit of them.
+func (db DB) archive(ns buckets, key, prev []byte, author string) error {
+	if prev == nil || db.HistoryLimit == 0 {
+		return nil
+	}
+	revs, err := ns.Bucket(historyBucket).CreateBucketIfNotExists(key)
+	if err != nil {
+		return err
+	}
+	seq, err := revs.NextSequence()
+	if err != nil {
+		return err
+	}
+	bs, err := json.Marshal(Revision{
+		Revision: seq,
+		Time:     time.Now().UTC(),
+		Author:   author,
+		Size:     len(prev),
+		Value:    prev,
+	})
+	if err != nil {
+		return err
+	}
+	err = revs.Put(revisionKey(seq), bs)
+	if err != nil {
+		return err
+	}
+	if db.HistoryLimit < 0 {
+		return nil
+	}
+	count := 0
+	c := revs.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		count++
+	}
+	for k, _ := c.First(); k != nil && count > db.HistoryLimit; k, _ = c.First() {
+		err = c.Delete()
+		if err != nil {
+			return err
+		}
+		count--
+	}
+	return nil
+}
+
+// GetRevision returns the given revision of a key, or ErrRevisionNotExists if
+// it does not exist or has been pruned.
+func (db DB) GetRevision(namespaceName, key string, rev uint64) (r *Revision, err error) {
+	err = db.View(func(tx *bolt.Tx) error {
+		ns := namespace(tx, namespaceName)
+		if ns == nil {
+			return ErrRevisionNotExists
+		}
+		revs := ns.Bucket(historyBucket).Bucket([]byte(key))
+		if revs == nil {
+			return ErrRevisionNotExists
+		}
+		bs := revs.Get(revisionKey(rev))
+		if bs == nil {
+			return ErrRevisionNotExists
+		}
+		if json.Unmarshal(bs, &r) != nil {
+			return ErrDBCorrupted
+		}
+		return nil
+	})
+	return
+}
+
+// History returns the archived revisions of a key, oldest first. The values
+// themselves are not included.
+func (db DB) History(namespaceName, key string) (revs []Revision, err error) {
+	err = db.View(func(tx *bolt.Tx) error {
+		ns := namespace(tx, namespaceName)
+		if ns == nil {
+			return nil
+		}
+		bucket := ns.Bucket(historyBucket).Bucket([]byte(key))
+		if bucket == nil {
+			return nil
+		}
+		c := bucket.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var r Revision
+			if json.Unmarshal(v, &r) != nil {
+				return ErrDBCorrupted
+			}
+			r.Value = nil
+			revs = append(revs, r)
+		}
+		return nil
+	})
+	return
+}
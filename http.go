@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/boltdb/bolt"
 	log "github.com/sirupsen/logrus"
@@ -16,100 +21,686 @@ func (db DB) ServeMux() *http.ServeMux {
 	sm := http.NewServeMux()
 	sm.HandleFunc("/user/", db.HttpAuth(db.HttpHandleUser))
 	sm.HandleFunc("/val/", db.HttpAuth(db.HttpVals))
+	sm.HandleFunc("/history/", db.HttpAuth(db.HttpHistory))
+	sm.HandleFunc("/meta/", db.HttpAuth(db.HttpMeta))
 	sm.HandleFunc("/listvals", db.HttpAuth(db.HttpListVals))
+	sm.HandleFunc("/txn", db.HttpAuth(db.HttpTxn))
+	sm.HandleFunc("/incr/", db.HttpAuth(db.HttpIncr))
 	sm.HandleFunc("/listusers", db.HttpAuth(db.HttpListUsers))
+	sm.HandleFunc("/users/import", db.HttpAuth(db.HttpImportUsers))
+	sm.HandleFunc("/users/export", db.HttpAuth(db.HttpExportUsers))
+	sm.HandleFunc("/group/", db.HttpAuth(db.HttpHandleGroup))
+	sm.HandleFunc("/groups", db.HttpAuth(db.HttpListGroups))
+	sm.HandleFunc("/ns/", db.HttpAuth(db.HttpNamespace))
+	sm.HandleFunc("/namespaces", db.HttpAuth(db.HttpListNamespaces))
+	sm.HandleFunc("/token", db.HttpAuth(db.HttpCreateToken))
+	sm.HandleFunc("/token/", db.HttpAuth(db.HttpRevokeToken))
+	sm.HandleFunc("/tokens", db.HttpAuth(db.HttpListTokens))
+	sm.HandleFunc("/audit", db.HttpAuth(db.HttpAudit))
+	sm.HandleFunc("/audit/verify", db.HttpAuth(db.HttpVerifyAudit))
 	sm.HandleFunc("/backup", db.HttpAuth(db.HttpBackup))
-	sm.HandleFunc("/", db.HttpAuth(http.NotFound))
+	sm.HandleFunc("/", db.HttpAuth(httpNotFound))
 	return sm
 }
 
+type contextKey int
+
+const (
+	namespaceKey contextKey = iota
+	identityKey
+)
+
+// requestNamespace returns the namespace the request operates on.
+func requestNamespace(r *http.Request) string {
+	ns, ok := r.Context().Value(namespaceKey).(string)
+	if !ok {
+		return DefaultNamespace
+	}
+	return ns
+}
+
+// requestIdentity returns the identity of the authenticated user doing the
+// request.
+func requestIdentity(r *http.Request) *Identity {
+	return r.Context().Value(identityKey).(*Identity)
+}
+
+// allowed returns true if the user doing the request has the given access to
+// the key in the request's namespace.
+func allowed(r *http.Request, key, access string) bool {
+	return requestIdentity(r).CanAccess(requestNamespace(r), key, access)
+}
+
+// checkAccess is like allowed, but also responds with 403 Forbidden if the
+// access is not allowed.
+func checkAccess(w http.ResponseWriter, r *http.Request, key, access string) bool {
+	if !allowed(r, key, access) {
+		httpError(w, r, ErrForbiddenKey, http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
 func (db DB) HttpAuth(handler func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		uname, pass, ok := r.BasicAuth()
-		if !ok {
-			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		authorized := false
+		if db.Audit != nil && auditable(r) {
+			// Requests that fail to authenticate never reach audited, so
+			// record them here.
+			sr := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			w = sr
+			defer func() {
+				if !authorized {
+					db.audit(r, uname, sr.status)
+				}
+			}()
+		}
+		bearer, isBearer := bearerToken(r)
+		certUser, hasCert := db.ClientCerts.User(r)
+		if !db.ClientCerts.Allows(ok || isBearer, hasCert) {
+			httpErrorMessage(w, r, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		ip := clientIP(r)
+		switch {
+		case isBearer:
+			uname = ""
+		case !ok:
+			uname = certUser
+		}
+		if wait := db.Logins.Blocked(uname, ip); wait > 0 {
+			log.Warnf("Throttled login as %q from %s", uname, ip)
+			w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+			httpErrorMessage(w, r, "Too many failed logins, try again later", http.StatusTooManyRequests)
 			return
 		}
+		isJWT := isBearer && db.JWT.Handles(bearer)
+		var jwtErr error
+		if isJWT {
+			uname, jwtErr = db.authorizeJWT(bearer)
+		}
+		var user *User
 		err := db.View(func(tx *bolt.Tx) error {
-			err := AuthorizeUser(tx, uname, pass)
+			var token *Token
+			var err error
+			if isJWT {
+				err = jwtErr
+				if err == nil {
+					user, err = getUser(tx, uname)
+				}
+			} else if isBearer {
+				token, user, err = AuthorizeToken(tx, bearer)
+				if token != nil {
+					uname = token.User
+				}
+			} else if ok {
+				user, err = db.authorizeUser(tx, uname, pass)
+			} else {
+				user, err = getUser(tx, uname)
+			}
+			if err == nil && db.ClientCerts.MustMatch() && uname != certUser {
+				log.Warnf("Credentials for %s do not match the client certificate for %s", uname, certUser)
+				err = ErrUnauthorized
+			}
 			if err != nil {
-				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				db.Logins.Failed(uname, ip)
+				httpErrorMessage(w, r, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 				return ErrUnauthorized
 			}
+			if isBearer {
+				db.Logins.Succeeded("", ip)
+			} else {
+				db.Logins.Succeeded(uname, ip)
+			}
+			if user.Disabled {
+				log.Warnf("Login as disabled user %s from %s", uname, ip)
+				httpError(w, r, ErrUserDisabled, http.StatusForbidden)
+				return ErrUserDisabled
+			}
+			id, err := loadIdentity(tx, uname, user)
+			if err != nil {
+				return err
+			}
+			id.Token = token
+			if user.MustChangePassword && !(r.Method == "PUT" && r.URL.Path == "/user/"+uname) {
+				httpError(w, r, ErrMustChangePassword, http.StatusForbidden)
+				return ErrMustChangePassword
+			}
+			r = r.WithContext(context.WithValue(r.Context(), identityKey, id))
 			return nil
 		})
+		switch {
+		case err == nil && ok && !isBearer:
+			db.rehashPassword(uname, pass, user)
+			fallthrough
+		case err == nil || err == ErrMustChangePassword:
+			db.recordLogin(uname, user)
+		case err == ErrUnauthorized && uname != "":
+			db.recordFailedLogin(uname)
+		}
 		switch err {
-		case ErrUnauthorized:
+		case ErrUnauthorized, ErrMustChangePassword, ErrUserDisabled:
 		case nil:
-			handler(w, r)
+			authorized = true
+			db.audited(w, r, handler)
 		default:
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			httpErrorMessage(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		}
 	}
 }
 
+// bearerToken returns the token in the Authorization header, if it is a bearer
+// token.
+func bearerToken(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(auth[7:]), true
+}
+
 func (db DB) HttpHandleUser(w http.ResponseWriter, r *http.Request) {
 	name := strings.TrimPrefix(r.URL.Path, "/user/")
 	if name == "" {
-		http.NotFound(w, r) // I guess?
+		httpNotFound(w, r) // I guess?
+		return
+	}
+	if strings.HasSuffix(name, "/acl") {
+		db.httpHandleACL(w, r, strings.TrimSuffix(name, "/acl"))
 		return
 	}
-	uname, _, _ := r.BasicAuth()
+	if strings.HasSuffix(name, "/roles") {
+		db.httpHandleRoles(w, r, strings.TrimSuffix(name, "/roles"))
+		return
+	}
+	if strings.HasSuffix(name, "/quota") {
+		db.httpHandleQuota(w, r, strings.TrimSuffix(name, "/quota"))
+		return
+	}
+	if strings.HasSuffix(name, "/unlock") {
+		db.httpUnlock(w, r, strings.TrimSuffix(name, "/unlock"))
+		return
+	}
+	if strings.HasSuffix(name, "/disable") || strings.HasSuffix(name, "/enable") {
+		db.httpSetDisabled(w, r, name)
+		return
+	}
+	caller := requestIdentity(r)
 	switch r.Method {
+	case "GET":
+		info, err := db.UserDetails(caller, name)
+		switch err {
+		case nil:
+			w.Header().Set("Content-Type", "application/json")
+			err = json.NewEncoder(w).Encode(info)
+			if err != nil {
+				log.Errorf("Unable to send body to request: %s", err)
+			}
+		case ErrForbiddenRoot:
+			httpError(w, r, err, http.StatusForbidden)
+		case ErrUserNotExists:
+			httpError(w, r, err, http.StatusNotFound)
+		default:
+			log.Errorf("Unexpected error getting user %s: %s", name, err)
+			httpErrorMessage(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
 	case "PUT":
 		body, err := ioutil.ReadAll(r.Body)
 		if err != nil {
 			log.Errorf("Unable to read request: %s", err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			httpErrorMessage(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		u, err := UnmarshalUser(name, body, db.Hasher, db.PasswordPolicy)
+		if pe, ok := err.(*PolicyError); ok {
+			w.Header().Set("X-Valheap-Reason", pe.Reason)
+			httpError(w, r, pe, http.StatusBadRequest)
 			return
 		}
-		u, err := UnmarshalUser(body)
 		if err != nil {
 			log.Errorf("PUT /user/%s: %s", name, err)
-			http.Error(w, `Request must be in JSON on form {"Password": "mypass"}`, http.StatusBadRequest)
+			httpErrorMessage(w, r, `Request must be in JSON on form {"Password": "mypass"}`, http.StatusBadRequest)
 			return
 		}
-		err = db.PutUser(uname, name, u)
+		err = db.PutUser(caller, name, u)
 		switch err {
-		case ErrForbiddenRoot:
-			http.Error(w, err.Error(), http.StatusForbidden)
+		case ErrForbiddenRoot, ErrForbiddenForToken:
+			httpError(w, r, err, http.StatusForbidden)
 		default:
 			log.Errorf("Unexpected error adding user: %s", err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			httpErrorMessage(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		case nil:
 			io.WriteString(w, "User updated/added\n")
 		}
 	case "DELETE":
-		err := db.RmUser(uname, name)
+		err := db.RmUser(caller, name)
 		switch err {
-		case ErrForbiddenRoot, ErrCannotDeleteRoot:
-			http.Error(w, err.Error(), http.StatusForbidden)
+		case ErrForbiddenRoot, ErrCannotDeleteRoot, ErrForbiddenForToken:
+			httpError(w, r, err, http.StatusForbidden)
 		case ErrUserNotExists:
-			http.Error(w, "The user does not exists", http.StatusConflict)
+			errorResponse(w, r, errorCodes[ErrUserNotExists], "The user does not exists", http.StatusConflict)
 		default:
 			log.Errorf("Unexpected error removing user: %s", err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			httpErrorMessage(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		case nil:
 			io.WriteString(w, "User removed\n")
 		}
 	default:
-		http.NotFound(w, r)
+		httpNotFound(w, r)
+		return
+	}
+}
+
+// httpUnlock serves /user/{name}/unlock, where a POST clears the user's failed
+// logins and lifts any lockout.
+func (db DB) httpUnlock(w http.ResponseWriter, r *http.Request, user string) {
+	if r.Method != "POST" {
+		httpNotFound(w, r)
+		return
+	}
+	err := db.Unlock(requestIdentity(r), user)
+	switch err {
+	case nil:
+		io.WriteString(w, "User unlocked\n")
+	case ErrForbiddenRoot:
+		httpError(w, r, err, http.StatusForbidden)
+	case ErrUserNotExists:
+		httpError(w, r, err, http.StatusNotFound)
+	default:
+		log.Errorf("Unexpected error unlocking user %s: %s", user, err)
+		httpErrorMessage(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+// httpSetDisabled serves /user/{name}/disable and /user/{name}/enable, where a
+// POST disables or enables the user.
+func (db DB) httpSetDisabled(w http.ResponseWriter, r *http.Request, path string) {
+	if r.Method != "POST" {
+		httpNotFound(w, r)
+		return
+	}
+	disable := strings.HasSuffix(path, "/disable")
+	user := strings.TrimSuffix(strings.TrimSuffix(path, "/disable"), "/enable")
+	err := db.SetDisabled(requestIdentity(r), user, disable)
+	switch {
+	case err == nil && disable:
+		io.WriteString(w, "User disabled\n")
+	case err == nil:
+		io.WriteString(w, "User enabled\n")
+	case err == ErrForbiddenRoot || err == ErrCannotDisableRoot:
+		httpError(w, r, err, http.StatusForbidden)
+	case err == ErrUserNotExists:
+		httpError(w, r, err, http.StatusNotFound)
+	default:
+		log.Errorf("Unexpected error disabling/enabling user %s: %s", user, err)
+		httpErrorMessage(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+// ruleFromQuery returns the rule given by the query parameters access,
+// namespace and prefix.
+func ruleFromQuery(r *http.Request) Rule {
+	q := r.URL.Query()
+	return Rule{
+		Access:    q.Get("access"),
+		Namespace: q.Get("namespace"),
+		Prefix:    q.Get("prefix"),
+	}
+}
+
+// httpHandleACL serves /user/{name}/acl. GET lists the user's rules, one per
+// line, as access, namespace (* for all) and prefix separated by tabs. POST
+// grants and DELETE revokes the rule given by the query parameters, and a DELETE
+// without an access parameter removes the ACL entirely.
+func (db DB) httpHandleACL(w http.ResponseWriter, r *http.Request, user string) {
+	caller := requestIdentity(r)
+	var err error
+	switch r.Method {
+	case "GET":
+		var acl ACL
+		var restricted bool
+		acl, restricted, err = db.ACL(caller, user)
+		if err == nil {
+			if !restricted {
+				io.WriteString(w, "User has access to all keys\n")
+			}
+			for _, rule := range acl {
+				ns := rule.Namespace
+				if ns == "" {
+					ns = "*"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\n", rule.Access, ns, rule.Prefix)
+			}
+			return
+		}
+	case "POST":
+		err = db.Grant(caller, user, ruleFromQuery(r))
+		if err == nil {
+			io.WriteString(w, "Access granted\n")
+			return
+		}
+	case "DELETE":
+		rule := ruleFromQuery(r)
+		if rule.Access == "" {
+			err = db.ClearACL(caller, user)
+		} else {
+			err = db.Revoke(caller, user, rule)
+		}
+		if err == nil {
+			io.WriteString(w, "Access revoked\n")
+			return
+		}
+	default:
+		httpNotFound(w, r)
+		return
+	}
+	switch err {
+	case ErrForbiddenRoot, ErrCannotRestrictRoot:
+		httpError(w, r, err, http.StatusForbidden)
+	case ErrBadRule:
+		httpError(w, r, err, http.StatusBadRequest)
+	case ErrUserNotExists, ErrRuleNotExists:
+		httpError(w, r, err, http.StatusNotFound)
+	default:
+		log.Errorf("Unexpected error managing ACL of %s: %s", user, err)
+		httpErrorMessage(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+// httpHandleRoles serves /user/{name}/roles. GET lists the effective roles of
+// the user, and PUT replaces the user's own roles with the role query
+// parameters.
+func (db DB) httpHandleRoles(w http.ResponseWriter, r *http.Request, user string) {
+	caller := requestIdentity(r)
+	var err error
+	switch r.Method {
+	case "GET":
+		var id *Identity
+		id, err = db.UserIdentity(caller, user)
+		if err == nil {
+			for _, role := range id.Roles {
+				fmt.Fprintln(w, role)
+			}
+			return
+		}
+	case "PUT":
+		err = db.SetRoles(caller, user, r.URL.Query()["role"])
+		if err == nil {
+			io.WriteString(w, "Roles updated\n")
+			return
+		}
+	default:
+		httpNotFound(w, r)
+		return
+	}
+	switch err {
+	case ErrForbiddenRoot, ErrCannotModifyRoot:
+		httpError(w, r, err, http.StatusForbidden)
+	case ErrBadRole:
+		httpError(w, r, err, http.StatusBadRequest)
+	case ErrUserNotExists:
+		httpError(w, r, err, http.StatusNotFound)
+	default:
+		log.Errorf("Unexpected error managing roles of %s: %s", user, err)
+		httpErrorMessage(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+// httpHandleQuota shows the quota and usage of the user on GET, and sets its
+// quota from the query parameters keys and bytes on PUT. A missing or zero
+// limit means no limit.
+func (db DB) httpHandleQuota(w http.ResponseWriter, r *http.Request, user string) {
+	caller := requestIdentity(r)
+	var err error
+	switch r.Method {
+	case "GET":
+		var info *QuotaInfo
+		info, err = db.QuotaInfo(caller, user)
+		if err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			err = json.NewEncoder(w).Encode(info)
+			if err != nil {
+				log.Errorf("Unable to send body to request: %s", err)
+			}
+			return
+		}
+	case "PUT":
+		var q Quota
+		q, err = parseQuota(r.URL.Query())
+		if err == nil {
+			err = db.SetQuota(caller, user, q)
+		}
+		if err == nil {
+			io.WriteString(w, "Quota updated\n")
+			return
+		}
+	default:
+		httpNotFound(w, r)
+		return
+	}
+	switch err {
+	case ErrForbiddenRoot:
+		httpError(w, r, err, http.StatusForbidden)
+	case ErrBadQuota:
+		httpError(w, r, err, http.StatusBadRequest)
+	case ErrUserNotExists:
+		httpError(w, r, err, http.StatusNotFound)
+	default:
+		log.Errorf("Unexpected error managing quota of %s: %s", user, err)
+		httpErrorMessage(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+func parseQuota(q url.Values) (quota Quota, err error) {
+	if keys := q.Get("keys"); keys != "" {
+		quota.MaxKeys, err = strconv.Atoi(keys)
+		if err != nil {
+			return quota, ErrBadQuota
+		}
+	}
+	if bytes := q.Get("bytes"); bytes != "" {
+		quota.MaxBytes, err = strconv.ParseInt(bytes, 10, 64)
+		if err != nil {
+			return quota, ErrBadQuota
+		}
+	}
+	return quota, nil
+}
+
+// HttpHandleGroup serves /group/{name}, where PUT creates or replaces the group
+// with the role query parameters and DELETE removes it, and
+// /group/{name}/member/{user}, where PUT adds the user to the group and DELETE
+// removes the user from it.
+func (db DB) HttpHandleGroup(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/group/")
+	user := ""
+	if i := strings.Index(name, "/member/"); i >= 0 {
+		name, user = name[:i], name[i+len("/member/"):]
+	}
+	if name == "" || strings.Contains(name, "/") {
+		httpNotFound(w, r)
+		return
+	}
+	caller := requestIdentity(r)
+	var err error
+	switch {
+	case r.Method == "PUT" && user != "":
+		err = db.SetMembership(caller, user, name, true)
+	case r.Method == "DELETE" && user != "":
+		err = db.SetMembership(caller, user, name, false)
+	case r.Method == "PUT":
+		err = db.PutGroup(caller, name, r.URL.Query()["role"])
+	case r.Method == "DELETE":
+		err = db.RmGroup(caller, name)
+	default:
+		httpNotFound(w, r)
+		return
+	}
+	switch err {
+	case nil:
+		io.WriteString(w, "Group updated\n")
+	case ErrForbiddenRoot, ErrCannotModifyRoot:
+		httpError(w, r, err, http.StatusForbidden)
+	case ErrBadRole:
+		httpError(w, r, err, http.StatusBadRequest)
+	case ErrUserNotExists, ErrGroupNotExists:
+		httpError(w, r, err, http.StatusNotFound)
+	default:
+		log.Errorf("Unexpected error managing group %s: %s", name, err)
+		httpErrorMessage(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+// HttpListGroups lists the groups, one per line, as the group name and its
+// comma separated roles separated by a tab.
+func (db DB) HttpListGroups(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		groups, err := db.ListGroups(requestIdentity(r))
+		switch err {
+		case ErrForbiddenRoot:
+			httpError(w, r, err, http.StatusForbidden)
+		default:
+			log.Errorf("Unable to list groups: %s", err)
+			httpErrorMessage(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		case nil:
+			names := make([]string, 0, len(groups))
+			for name := range groups {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				_, err := fmt.Fprintf(w, "%s\t%s\n", name, strings.Join(groups[name].Roles, ","))
+				if err != nil {
+					log.Errorf("Unable to send body to request: %s", err)
+					return
+				}
+			}
+		}
+	default:
+		httpNotFound(w, r)
+	}
+}
+
+// HttpCreateToken mints a token for the caller on POST, and returns it as a
+// single line. The description, expires (seconds or a duration), readonly and
+// prefix query parameters set the properties of the token.
+func (db DB) HttpCreateToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		httpNotFound(w, r)
+		return
+	}
+	q := r.URL.Query()
+	t := Token{
+		Description: q.Get("description"),
+		ReadOnly:    q.Get("readonly") == "true",
+		Prefix:      q.Get("prefix"),
+	}
+	expires, err := parseTTL(q.Get("expires"))
+	if err != nil {
+		httpError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	if expires != 0 {
+		t.Expires = time.Now().UTC().Add(expires)
+	}
+	secret, _, err := db.CreateToken(requestIdentity(r), t)
+	switch err {
+	case nil:
+		io.WriteString(w, secret+"\n")
+	case ErrForbiddenForToken:
+		httpError(w, r, err, http.StatusForbidden)
+	default:
+		log.Errorf("Unable to create token: %s", err)
+		httpErrorMessage(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+// HttpRevokeToken deletes the token /token/{id} on DELETE.
+func (db DB) HttpRevokeToken(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/token/")
+	if id == "" || r.Method != "DELETE" {
+		httpNotFound(w, r)
+		return
+	}
+	err := db.RevokeToken(requestIdentity(r), id)
+	switch err {
+	case nil:
+		io.WriteString(w, "Token revoked\n")
+	case ErrForbiddenRoot, ErrForbiddenForToken:
+		httpError(w, r, err, http.StatusForbidden)
+	case ErrTokenNotExists:
+		httpError(w, r, err, http.StatusNotFound)
+	default:
+		log.Errorf("Unable to revoke token %s: %s", id, err)
+		httpErrorMessage(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+// HttpListTokens lists the caller's tokens, one per line, as the token id,
+// creation time, expiry time (- if none), scope and description separated by
+// tabs. The scope is either read or write, followed by the prefix if any.
+func (db DB) HttpListTokens(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		httpNotFound(w, r)
+		return
+	}
+	toks, err := db.ListTokens(requestIdentity(r))
+	switch err {
+	case nil:
+	case ErrForbiddenForToken:
+		httpError(w, r, err, http.StatusForbidden)
+		return
+	default:
+		log.Errorf("Unable to list tokens: %s", err)
+		httpErrorMessage(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
+	for _, t := range toks {
+		expires := "-"
+		if !t.Expires.IsZero() {
+			expires = t.Expires.Format(time.RFC3339)
+		}
+		scope := AccessWrite
+		if t.ReadOnly {
+			scope = AccessRead
+		}
+		if t.Prefix != "" {
+			scope += ":" + t.Prefix
+		}
+		_, err := fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", t.ID, t.Created.Format(time.RFC3339), expires, scope, t.Description)
+		if err != nil {
+			log.Errorf("Unable to send body to request: %s", err)
+			return
+		}
+	}
 }
 
 func (db DB) HttpListUsers(w http.ResponseWriter, r *http.Request) {
-	uname, _, _ := r.BasicAuth()
+	caller := requestIdentity(r)
 	switch r.Method {
 	case "GET":
-		keys, err := db.ListUsers(uname)
+		keys, err := db.ListUsers(caller)
 		switch err {
 		case ErrForbiddenRoot:
-			http.Error(w, err.Error(), http.StatusForbidden)
+			httpError(w, r, err, http.StatusForbidden)
 		default:
 			log.Errorf("Unable to list users: %s", err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			httpErrorMessage(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		case nil:
+			if acceptsJSON(r) {
+				names := make([]string, len(keys))
+				for i, key := range keys {
+					names[i] = string(key)
+				}
+				w.Header().Set("Content-Type", "application/json")
+				err = json.NewEncoder(w).Encode(names)
+				if err != nil {
+					log.Errorf("Unable to send body to request: %s", err)
+				}
+				return
+			}
 			for _, key := range keys {
 				_, err := w.Write(key)
 				if err == nil {
@@ -122,88 +713,700 @@ func (db DB) HttpListUsers(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 	default:
-		http.NotFound(w, r)
+		httpNotFound(w, r)
+	}
+}
+
+// HttpImportUsers imports the users in the htpasswd file in the request body,
+// and responds with the result of each line. Existing users are only updated
+// if the query parameter overwrite is true.
+func (db DB) HttpImportUsers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		httpNotFound(w, r)
+		return
+	}
+	overwrite := r.URL.Query().Get("overwrite") == "true"
+	results, err := db.ImportUsers(requestIdentity(r), r.Body, overwrite)
+	switch err {
+	case nil:
+	case ErrForbiddenRoot:
+		httpError(w, r, err, http.StatusForbidden)
+		return
+	default:
+		log.Errorf("Unable to import users: %s", err)
+		httpErrorMessage(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	for _, res := range results {
+		_, err := fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", res.Line, res.User, res.Result, res.Reason)
+		if err != nil {
+			log.Errorf("Unable to send body to request: %s", err)
+			return
+		}
+	}
+}
+
+func (db DB) HttpExportUsers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		httpNotFound(w, r)
+		return
+	}
+	err := db.ExportUsers(requestIdentity(r), w)
+	switch err {
+	case nil:
+	case ErrForbiddenRoot:
+		httpError(w, r, err, http.StatusForbidden)
+	default:
+		log.Errorf("Unable to export users: %s", err)
+		httpErrorMessage(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+// listOptions parses the list options from the query parameters prefix,
+// start_after, end, reverse, limit and long.
+func listOptions(r *http.Request) (opts ListOptions, err error) {
+	q := r.URL.Query()
+	opts.Prefix = q.Get("prefix")
+	opts.StartAfter = q.Get("start_after")
+	opts.End = q.Get("end")
+	opts.Reverse = q.Get("reverse") == "true"
+	opts.WithMeta = q.Get("long") == "true"
+	if limit := q.Get("limit"); limit != "" {
+		opts.Limit, err = strconv.Atoi(limit)
+		if err == nil && opts.Limit <= 0 {
+			err = fmt.Errorf("limit must be positive")
+		}
 	}
+	return
+}
+
+// listEntry is a key listed in JSON in the long format. The other fields are
+// left out for keys without metadata.
+type listEntry struct {
+	Key        string
+	Size       *int       `json:",omitempty"`
+	Modified   *time.Time `json:",omitempty"`
+	ModifiedBy string     `json:",omitempty"`
 }
 
+func newListEntry(key []byte, m *Meta) listEntry {
+	e := listEntry{Key: string(key)}
+	if m != nil {
+		e.Size, e.Modified, e.ModifiedBy = &m.Size, &m.Modified, m.ModifiedBy
+	}
+	return e
+}
+
+// HttpListVals lists keys separated by newlines, streamed directly from the
+// database. If a limit is given and there are more keys, the X-Valheap-Next
+// header contains the query escaped value to pass as start_after to get the next
+// page. In the long format, the size, modification time and last writer of the
+// key precede it, separated by tabs. Keys without metadata have these fields set
+// to "-". Clients accepting JSON get a JSON list of keys instead, or of
+// listEntry values in the long format.
 func (db DB) HttpListVals(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
-		prefix := r.URL.Query().Get("prefix")
-		keys, err := db.List(prefix)
+		opts, err := listOptions(r)
 		if err != nil {
-			log.Errorf("Unable to list keys with prefix %q: %s", prefix, err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			httpErrorMessage(w, r, fmt.Sprintf("Bad list parameters: %s", err), http.StatusBadRequest)
+			return
+		}
+		caller := requestIdentity(r)
+		if !caller.HasRole(RoleReader) && !caller.HasRole(RoleWriter) {
+			httpError(w, r, ErrForbiddenKey, http.StatusForbidden)
 			return
 		}
-		for _, key := range keys {
+		if caller.Restricted || caller.Token != nil {
+			opts.Filter = func(key []byte) bool {
+				return allowed(r, string(key), AccessRead)
+			}
+		}
+		asJSON := acceptsJSON(r)
+		started := false
+		sep := "["
+		begin := func(next []byte) {
+			if next != nil {
+				w.Header().Set("X-Valheap-Next", url.QueryEscape(string(next)))
+			}
+			if asJSON {
+				w.Header().Set("Content-Type", "application/json")
+			}
+			started = true
+		}
+		err = db.List(requestNamespace(r), opts, begin, func(key []byte, m *Meta) error {
+			if asJSON {
+				var v interface{} = string(key)
+				if opts.WithMeta {
+					v = newListEntry(key, m)
+				}
+				bs, err := json.Marshal(v)
+				if err == nil {
+					_, err = io.WriteString(w, sep)
+				}
+				if err == nil {
+					_, err = w.Write(bs)
+				}
+				sep = ","
+				return err
+			}
+			if opts.WithMeta {
+				size, modified, modifiedBy := "-", "-", "-"
+				if m != nil {
+					size = strconv.Itoa(m.Size)
+					modified = m.Modified.Format(time.RFC3339)
+					modifiedBy = m.ModifiedBy
+				}
+				_, err := fmt.Fprintf(w, "%s\t%s\t%s\t", size, modified, modifiedBy)
+				if err != nil {
+					return err
+				}
+			}
 			_, err := w.Write(key)
 			if err == nil {
 				_, err = w.Write([]byte{'\n'})
 			}
+			return err
+		})
+		if err != nil {
+			log.Errorf("Unable to list keys with prefix %q: %s", opts.Prefix, err)
+			if !started {
+				httpErrorMessage(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+		}
+		if asJSON {
+			end := "]\n"
+			if sep == "[" {
+				end = "[]\n" // no keys
+			}
+			_, err = io.WriteString(w, end)
 			if err != nil {
 				log.Errorf("Unable to send body to request: %s", err)
-				return
 			}
 		}
 	default:
-		http.NotFound(w, r)
+		httpNotFound(w, r)
+	}
+}
+
+// parseTTL parses a TTL, which is either a number of seconds or a duration
+// like "10m". The empty string is parsed as no TTL.
+func parseTTL(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if secs, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return time.Duration(secs) * time.Second, nil
+	}
+	ttl, err := time.ParseDuration(s)
+	if err == nil && ttl <= 0 {
+		err = fmt.Errorf("TTL must be positive, was %s", s)
 	}
+	return ttl, err
+}
+
+// writeOptions returns the write options specified by the request's If-Match
+// and If-None-Match headers, and the TTL from either the ttl query parameter or
+// the X-Valheap-TTL header.
+func writeOptions(r *http.Request) (opts WriteOptions, err error) {
+	opts.Author = requestIdentity(r).Name
+	opts.ContentType = r.Header.Get("Content-Type")
+	opts.IfMatch = r.Header.Get("If-Match")
+	opts.IfNoneMatch = r.Header.Get("If-None-Match")
+	ttl := r.URL.Query().Get("ttl")
+	if ttl == "" {
+		ttl = r.Header.Get("X-Valheap-TTL")
+	}
+	opts.TTL, err = parseTTL(ttl)
+	return
 }
 
 func (db DB) HttpVals(w http.ResponseWriter, r *http.Request) {
 	keyStr := strings.TrimPrefix(r.URL.Path, "/val/")
+	access := AccessWrite
+	switch r.Method {
+	case "GET", "HEAD":
+		access = AccessRead
+	case "PUT", "POST", "DELETE":
+	default:
+		httpNotFound(w, r)
+		return
+	}
+	if !checkAccess(w, r, keyStr, access) {
+		return
+	}
 	switch r.Method {
 	case "PUT":
 		// read value
 		body, err := ioutil.ReadAll(r.Body)
 		if err != nil {
 			log.Errorf("Unable to read request: %s", err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			httpErrorMessage(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
-		err = db.Put(keyStr, body)
+		opts, err := writeOptions(r)
 		if err != nil {
+			httpErrorMessage(w, r, fmt.Sprintf("Bad TTL: %s", err), http.StatusBadRequest)
+			return
+		}
+		etag, err := db.Put(requestNamespace(r), keyStr, body, opts)
+		switch err {
+		case nil:
+		case ErrPreconditionFailed:
+			httpErrorMessage(w, r, http.StatusText(http.StatusPreconditionFailed), http.StatusPreconditionFailed)
+			return
+		case ErrKeyQuotaExceeded, ErrByteQuotaExceeded:
+			httpError(w, r, err, http.StatusInsufficientStorage)
+			return
+		case ErrBadNamespace:
+			httpError(w, r, err, http.StatusBadRequest)
+			return
+		default:
 			log.Errorf("Unable to put key: %s", err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			httpErrorMessage(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
+		w.Header().Set("ETag", etag)
 		_, err = w.Write(body)
 		if err != nil {
 			log.Errorf("Unable to send body to request: %s", err)
 		}
-	case "GET":
-		val, err := db.Get(keyStr)
+	case "POST":
+		db.httpAppend(w, r, keyStr)
+	case "GET", "HEAD":
+		if version := r.URL.Query().Get("version"); version != "" {
+			db.httpGetRevision(w, r, keyStr, version)
+			return
+		}
+		entry, err := db.Get(requestNamespace(r), keyStr)
 		if err != nil {
 			log.Errorf("Unable to retrieve key %q: %s", keyStr, err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			httpErrorMessage(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
-		if val == nil {
-			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		if entry == nil {
+			httpErrorMessage(w, r, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 			return
 		}
-		_, err = w.Write(val)
+		w.Header().Set("ETag", ETag(entry.Value))
+		if !entry.Expires.IsZero() {
+			remaining := entry.Expires.Sub(time.Now())
+			w.Header().Set("X-Valheap-Expires", entry.Expires.UTC().Format(time.RFC3339))
+			w.Header().Set("X-Valheap-TTL", strconv.Itoa(int(remaining.Seconds()+0.5)))
+		}
+		if entry.Meta != nil {
+			w.Header().Set("Last-Modified", entry.Meta.Modified.Format(http.TimeFormat))
+			w.Header().Set("X-Valheap-Modified-By", entry.Meta.ModifiedBy)
+			if entry.Meta.ContentType != "" {
+				w.Header().Set("Content-Type", entry.Meta.ContentType)
+			}
+		}
+		if inm := r.Header.Get("If-None-Match"); inm != "" && etagMatches(inm, entry.Value) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		_, err = w.Write(entry.Value)
 		if err != nil {
 			log.Errorf("Unable to send body to request: %s", err)
 		}
 	case "DELETE":
-		err := db.Delete(keyStr)
-		if err != nil {
+		opts, _ := writeOptions(r)
+		err := db.Delete(requestNamespace(r), keyStr, opts)
+		switch err {
+		case nil:
+		case ErrPreconditionFailed:
+			httpErrorMessage(w, r, http.StatusText(http.StatusPreconditionFailed), http.StatusPreconditionFailed)
+			return
+		default:
 			log.Errorf("Unable to delete key %q: %s", keyStr, err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			httpErrorMessage(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
 		fmt.Fprintf(w, "Key %s deleted\n", keyStr)
+	}
+}
+
+// httpAppend appends the request body to the key. If the query parameter max is
+// set, the append is rejected if the new value would be larger than max bytes.
+func (db DB) httpAppend(w http.ResponseWriter, r *http.Request, keyStr string) {
+	maxSize := 0
+	if maxStr := r.URL.Query().Get("max"); maxStr != "" {
+		var err error
+		maxSize, err = strconv.Atoi(maxStr)
+		if err != nil || maxSize <= 0 {
+			httpErrorMessage(w, r, "max must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Errorf("Unable to read request: %s", err)
+		httpErrorMessage(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	opts, _ := writeOptions(r)
+	etag, err := db.Append(requestNamespace(r), keyStr, body, maxSize, opts)
+	switch err {
+	case nil:
+		w.Header().Set("ETag", etag)
+		fmt.Fprintf(w, "Appended %d bytes to %s\n", len(body), keyStr)
+	case ErrPreconditionFailed:
+		httpErrorMessage(w, r, http.StatusText(http.StatusPreconditionFailed), http.StatusPreconditionFailed)
+	case ErrTooLarge:
+		httpError(w, r, err, http.StatusRequestEntityTooLarge)
+	case ErrKeyQuotaExceeded, ErrByteQuotaExceeded:
+		httpError(w, r, err, http.StatusInsufficientStorage)
+	case ErrBadNamespace:
+		httpError(w, r, err, http.StatusBadRequest)
+	default:
+		log.Errorf("Unable to append to key %q: %s", keyStr, err)
+		httpErrorMessage(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+func (db DB) httpGetRevision(w http.ResponseWriter, r *http.Request, keyStr, version string) {
+	rev, err := strconv.ParseUint(version, 10, 64)
+	if err != nil {
+		httpErrorMessage(w, r, "version must be a revision number", http.StatusBadRequest)
+		return
+	}
+	revision, err := db.GetRevision(requestNamespace(r), keyStr, rev)
+	switch err {
+	case nil:
+	case ErrRevisionNotExists:
+		httpErrorMessage(w, r, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	default:
+		log.Errorf("Unable to retrieve revision %d of key %q: %s", rev, keyStr, err)
+		httpErrorMessage(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("ETag", ETag(revision.Value))
+	w.Header().Set("X-Valheap-Revision", strconv.FormatUint(revision.Revision, 10))
+	_, err = w.Write(revision.Value)
+	if err != nil {
+		log.Errorf("Unable to send body to request: %s", err)
+	}
+}
+
+func (db DB) HttpHistory(w http.ResponseWriter, r *http.Request) {
+	keyStr := strings.TrimPrefix(r.URL.Path, "/history/")
+	if !checkAccess(w, r, keyStr, AccessRead) {
+		return
+	}
+	switch r.Method {
+	case "GET":
+		revs, err := db.History(requestNamespace(r), keyStr)
+		if err != nil {
+			log.Errorf("Unable to retrieve history of key %q: %s", keyStr, err)
+			httpErrorMessage(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		for _, rev := range revs {
+			_, err := fmt.Fprintf(w, "%d\t%s\t%s\t%d\n", rev.Revision, rev.Time.Format(time.RFC3339), rev.Author, rev.Size)
+			if err != nil {
+				log.Errorf("Unable to send body to request: %s", err)
+				return
+			}
+		}
+	default:
+		httpNotFound(w, r)
+	}
+}
+
+func (db DB) HttpMeta(w http.ResponseWriter, r *http.Request) {
+	keyStr := strings.TrimPrefix(r.URL.Path, "/meta/")
+	if !checkAccess(w, r, keyStr, AccessRead) {
+		return
+	}
+	switch r.Method {
+	case "GET":
+		km, err := db.GetMeta(requestNamespace(r), keyStr)
+		if err != nil {
+			log.Errorf("Unable to retrieve metadata of key %q: %s", keyStr, err)
+			httpErrorMessage(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if km == nil {
+			httpErrorMessage(w, r, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(km)
+		if err != nil {
+			log.Errorf("Unable to send body to request: %s", err)
+		}
+	default:
+		httpNotFound(w, r)
+	}
+}
+
+func (db DB) HttpTxn(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.Errorf("Unable to read request: %s", err)
+			httpErrorMessage(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		ops, err := ParseTxn(body)
+		if err != nil {
+			httpErrorMessage(w, r, fmt.Sprintf("Bad transaction: %s", err), http.StatusBadRequest)
+			return
+		}
+		for _, op := range ops {
+			access := AccessWrite
+			if op.Op == "check" {
+				access = AccessRead
+			}
+			if !checkAccess(w, r, op.Key, access) {
+				return
+			}
+		}
+		caller := requestIdentity(r)
+		err = db.Txn(requestNamespace(r), ops, caller.Name)
+		switch err := err.(type) {
+		case nil:
+			fmt.Fprintf(w, "Transaction committed (%d operations)\n", len(ops))
+		case *TxnError:
+			w.Header().Set("X-Valheap-Failed-Op", strconv.Itoa(err.Index))
+			httpError(w, r, err, http.StatusPreconditionFailed)
+		default:
+			if err == ErrBadNamespace {
+				httpError(w, r, err, http.StatusBadRequest)
+				return
+			}
+			if err == ErrKeyQuotaExceeded || err == ErrByteQuotaExceeded {
+				httpError(w, r, err, http.StatusInsufficientStorage)
+				return
+			}
+			log.Errorf("Unable to perform transaction: %s", err)
+			httpErrorMessage(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+	default:
+		httpNotFound(w, r)
+	}
+}
+
+func (db DB) HttpIncr(w http.ResponseWriter, r *http.Request) {
+	keyStr := strings.TrimPrefix(r.URL.Path, "/incr/")
+	if !checkAccess(w, r, keyStr, AccessWrite) {
+		return
+	}
+	switch r.Method {
+	case "POST":
+		by := int64(1)
+		if byStr := r.URL.Query().Get("by"); byStr != "" {
+			var err error
+			by, err = strconv.ParseInt(byStr, 10, 64)
+			if err != nil {
+				httpErrorMessage(w, r, "by must be an integer", http.StatusBadRequest)
+				return
+			}
+		}
+		caller := requestIdentity(r)
+		n, err := db.Incr(requestNamespace(r), keyStr, by, caller.Name)
+		switch err {
+		case nil:
+			fmt.Fprintln(w, n)
+		case ErrNotInteger, ErrOverflow:
+			httpError(w, r, err, http.StatusConflict)
+		case ErrKeyQuotaExceeded, ErrByteQuotaExceeded:
+			httpError(w, r, err, http.StatusInsufficientStorage)
+		case ErrBadNamespace:
+			httpError(w, r, err, http.StatusBadRequest)
+		default:
+			log.Errorf("Unable to increment key %q: %s", keyStr, err)
+			httpErrorMessage(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+	default:
+		httpNotFound(w, r)
+	}
+}
+
+// HttpNamespace serves /ns/{namespace}/..., where the remaining path is handled
+// like the corresponding unnamespaced path inside that namespace. A PUT or
+// DELETE on /ns/{namespace} itself creates or drops the namespace.
+func (db DB) HttpNamespace(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/ns/")
+	ns, rest := path, ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		ns, rest = path[:i], path[i:]
+	}
+	if ns == "" {
+		httpNotFound(w, r)
+		return
+	}
+	if rest == "" || rest == "/" {
+		db.httpHandleNamespace(w, r, ns)
+		return
+	}
+
+	u := *r.URL
+	u.Path = rest
+	r = r.WithContext(context.WithValue(r.Context(), namespaceKey, ns))
+	r.URL = &u
+	switch {
+	case strings.HasPrefix(rest, "/val/"):
+		db.HttpVals(w, r)
+	case strings.HasPrefix(rest, "/history/"):
+		db.HttpHistory(w, r)
+	case strings.HasPrefix(rest, "/meta/"):
+		db.HttpMeta(w, r)
+	case rest == "/listvals":
+		db.HttpListVals(w, r)
+	case rest == "/txn":
+		db.HttpTxn(w, r)
+	case strings.HasPrefix(rest, "/incr/"):
+		db.HttpIncr(w, r)
+	default:
+		httpNotFound(w, r)
+	}
+}
+
+func (db DB) httpHandleNamespace(w http.ResponseWriter, r *http.Request, ns string) {
+	caller := requestIdentity(r)
+	switch r.Method {
+	case "PUT":
+		err := db.CreateNamespace(caller, ns)
+		switch err {
+		case ErrForbiddenRoot:
+			httpError(w, r, err, http.StatusForbidden)
+		case ErrNamespaceExists:
+			httpError(w, r, err, http.StatusConflict)
+		case ErrBadNamespace:
+			httpError(w, r, err, http.StatusBadRequest)
+		default:
+			log.Errorf("Unexpected error creating namespace: %s", err)
+			httpErrorMessage(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		case nil:
+			fmt.Fprintf(w, "Namespace %s created\n", ns)
+		}
+	case "DELETE":
+		err := db.DropNamespace(caller, ns)
+		switch err {
+		case ErrForbiddenRoot, ErrCannotDropDefault:
+			httpError(w, r, err, http.StatusForbidden)
+		case ErrNamespaceNotExists:
+			httpError(w, r, err, http.StatusNotFound)
+		default:
+			log.Errorf("Unexpected error dropping namespace: %s", err)
+			httpErrorMessage(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		case nil:
+			fmt.Fprintf(w, "Namespace %s dropped\n", ns)
+		}
+	default:
+		httpNotFound(w, r)
+	}
+}
+
+func (db DB) HttpListNamespaces(w http.ResponseWriter, r *http.Request) {
+	caller := requestIdentity(r)
+	switch r.Method {
+	case "GET":
+		names, err := db.ListNamespaces(caller)
+		switch err {
+		case ErrForbiddenRoot:
+			httpError(w, r, err, http.StatusForbidden)
+		default:
+			log.Errorf("Unable to list namespaces: %s", err)
+			httpErrorMessage(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		case nil:
+			for _, name := range names {
+				_, err := fmt.Fprintln(w, name)
+				if err != nil {
+					log.Errorf("Unable to send body to request: %s", err)
+					return
+				}
+			}
+		}
+	default:
+		httpNotFound(w, r)
+	}
+}
+
+// parseAuditTime parses a time given either in RFC 3339 format or as a duration
+// before now.
+func parseAuditTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// HttpAudit returns the audit log as JSON lines, filtered by the query
+// parameters since and until (RFC 3339 times or durations before now), user
+// and limit.
+func (db DB) HttpAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		httpNotFound(w, r)
+		return
+	}
+	q := r.URL.Query()
+	var f AuditFilter
+	var err error
+	f.Since, err = parseAuditTime(q.Get("since"))
+	if err == nil {
+		f.Until, err = parseAuditTime(q.Get("until"))
+	}
+	if err == nil && q.Get("limit") != "" {
+		f.Limit, err = strconv.Atoi(q.Get("limit"))
+	}
+	if err != nil {
+		httpErrorMessage(w, r, fmt.Sprintf("Bad audit parameters: %s", err), http.StatusBadRequest)
+		return
+	}
+	f.User = q.Get("user")
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	started := false
+	err = db.AuditEntries(requestIdentity(r), f, func(e *AuditEntry) error {
+		started = true
+		return enc.Encode(e)
+	})
+	switch {
+	case err == nil:
+	case err == ErrForbiddenRoot:
+		httpError(w, r, err, http.StatusForbidden)
+	case started:
+		log.Errorf("Unable to send audit log: %s", err)
+	default:
+		log.Errorf("Unable to read audit log: %s", err)
+		httpErrorMessage(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+// HttpVerifyAudit checks the hash chain of the audit log, and responds with
+// 409 Conflict if it is broken.
+func (db DB) HttpVerifyAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		httpNotFound(w, r)
+		return
+	}
+	n, err := db.VerifyAudit(requestIdentity(r))
+	switch err {
+	case nil:
+		fmt.Fprintf(w, "Audit log intact (%d entries)\n", n)
+	case ErrForbiddenRoot:
+		httpError(w, r, err, http.StatusForbidden)
+	case ErrAuditDisabled:
+		httpError(w, r, err, http.StatusServiceUnavailable)
+	case ErrDBCorrupted:
+		log.Errorf("Unable to verify audit log: %s", err)
+		httpErrorMessage(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 	default:
-		http.NotFound(w, r)
+		httpError(w, r, err, http.StatusConflict)
 	}
 }
 
 func (db DB) HttpBackup(w http.ResponseWriter, r *http.Request) {
-	uname, _, _ := r.BasicAuth()
-	if uname != "root" {
-		http.Error(w, ErrForbiddenRoot.Error(), http.StatusForbidden)
+	if !requestIdentity(r).HasRole(RoleBackup) {
+		httpError(w, r, ErrForbiddenRole, http.StatusForbidden)
 		return
 	}
 	err := db.View(func(tx *bolt.Tx) error {
@@ -213,6 +1416,6 @@ func (db DB) HttpBackup(w http.ResponseWriter, r *http.Request) {
 		return err
 	})
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, r, err, http.StatusInternalServerError)
 	}
 }
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// errorCodes are the codes of the errors that may be sent to clients, used in
+// JSON error responses. Other errors get a code from their status code.
+var errorCodes = map[error]string{
+	ErrUnauthorized:       "unauthorized",
+	ErrForbiddenRoot:      "forbidden_root",
+	ErrForbiddenKey:       "forbidden_key",
+	ErrForbiddenRole:      "forbidden_role",
+	ErrForbiddenForToken:  "forbidden_for_token",
+	ErrMustChangePassword: "must_change_password",
+	ErrUserNotExists:      "user_not_exists",
+	ErrUserDisabled:       "user_disabled",
+	ErrCannotDeleteRoot:   "cannot_delete_root",
+	ErrCannotDisableRoot:  "cannot_disable_root",
+	ErrCannotModifyRoot:   "cannot_modify_root",
+	ErrCannotRestrictRoot: "cannot_restrict_root",
+	ErrDBCorrupted:        "db_corrupted",
+	ErrBadRole:            "bad_role",
+	ErrBadRule:            "bad_rule",
+	ErrRuleNotExists:      "rule_not_exists",
+	ErrGroupNotExists:     "group_not_exists",
+	ErrBadNamespace:       "bad_namespace",
+	ErrNamespaceExists:    "namespace_exists",
+	ErrNamespaceNotExists: "namespace_not_exists",
+	ErrCannotDropDefault:  "cannot_drop_default",
+	ErrPreconditionFailed: "precondition_failed",
+	ErrRevisionNotExists:  "revision_not_exists",
+	ErrTooLarge:           "too_large",
+	ErrNotInteger:         "not_integer",
+	ErrOverflow:           "overflow",
+	ErrTokenNotExists:     "token_not_exists",
+	ErrBadQuota:           "bad_quota",
+	ErrKeyQuotaExceeded:   "key_quota_exceeded",
+	ErrByteQuotaExceeded:  "byte_quota_exceeded",
+	ErrAuditDisabled:      "audit_disabled",
+}
+
+// ErrorBody is the body of JSON error responses.
+type ErrorBody struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// acceptsJSON returns true if the client asks for JSON responses.
+func acceptsJSON(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(accept)
+		if err == nil && mediaType == "application/json" {
+			return true
+		}
+	}
+	return false
+}
+
+// statusCode returns the error code for a status without a more specific code,
+// like not_found for 404.
+func statusCode(status int) string {
+	return strings.ToLower(strings.Replace(http.StatusText(status), " ", "_", -1))
+}
+
+// errorCode returns the code of the error.
+func errorCode(err error, status int) string {
+	if pe, ok := err.(*PolicyError); ok {
+		return "password_" + strings.Replace(pe.Reason, "-", "_", -1)
+	}
+	if code, ok := errorCodes[err]; ok {
+		return code
+	}
+	return statusCode(status)
+}
+
+// errorResponse responds with the error code and message, either in a JSON
+// error body if the client accepts JSON, or as plain text like http.Error.
+func errorResponse(w http.ResponseWriter, r *http.Request, code, message string, status int) {
+	if !acceptsJSON(r) {
+		http.Error(w, message, status)
+		return
+	}
+	var body ErrorBody
+	body.Error.Code = code
+	body.Error.Message = message
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(body)
+	if err != nil {
+		log.Errorf("Unable to send body to request: %s", err)
+	}
+}
+
+// httpError responds with the error and status.
+func httpError(w http.ResponseWriter, r *http.Request, err error, status int) {
+	errorResponse(w, r, errorCode(err, status), err.Error(), status)
+}
+
+// httpErrorMessage responds with the message and status, with the status' code.
+func httpErrorMessage(w http.ResponseWriter, r *http.Request, message string, status int) {
+	errorResponse(w, r, statusCode(status), message, status)
+}
+
+// httpNotFound is like http.NotFound, but responds in JSON to clients that
+// accept it.
+func httpNotFound(w http.ResponseWriter, r *http.Request) {
+	httpErrorMessage(w, r, "404 page not found", http.StatusNotFound)
+}
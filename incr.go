@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"strconv"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	ErrNotInteger = errors.New("The value is not an integer")
+	ErrOverflow   = errors.New("The increment would overflow")
+)
+
+// Incr adds by to the decimal integer stored under key and returns the new
+// value. A missing key is treated as 0, and surrounding whitespace in the
+// stored value is ignored. The key's TTL and content type are kept.
+func (db DB) Incr(namespaceName, key string, by int64, author string) (n int64, err error) {
+	err = db.Update(func(tx *bolt.Tx) error {
+		ns, err := ensureNamespace(tx, namespaceName)
+		if err != nil {
+			return err
+		}
+		if cur := liveValue(ns, []byte(key)); cur != nil {
+			n, err = strconv.ParseInt(string(bytes.TrimSpace(cur)), 10, 64)
+			if err != nil {
+				return ErrNotInteger
+			}
+		}
+		if (by > 0 && n > math.MaxInt64-by) || (by < 0 && n < math.MinInt64-by) {
+			return ErrOverflow
+		}
+		n += by
+		val := []byte(strconv.FormatInt(n, 10))
+		return db.putValue(ns, []byte(key), val, WriteOptions{Author: author, KeepTTL: true})
+	})
+	return
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIncrKeepsTTLAndContentType(t *testing.T) {
+	db := newTestDB(t)
+	_, err := db.Put(DefaultNamespace, "counter", []byte("41"), WriteOptions{Author: "root", TTL: time.Hour, ContentType: "text/plain"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := db.Incr(DefaultNamespace, "counter", 1, "root")
+	if err != nil || n != 42 {
+		t.Fatalf("Expected 42, got %d (%v)", n, err)
+	}
+	entry, err := db.Get(DefaultNamespace, "counter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(entry.Value) != "42" {
+		t.Errorf("Expected the value 42, got %q", entry.Value)
+	}
+	if entry.Expires.IsZero() {
+		t.Errorf("Expected the TTL to be kept")
+	}
+	if ct := contentType(t, db, "counter"); ct != "text/plain" {
+		t.Errorf("Expected the content type to be kept, got %q", ct)
+	}
+}
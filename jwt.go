@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/boltdb/bolt"
+	log "github.com/sirupsen/logrus"
+)
+
+// The JWT signature algorithms that are accepted.
+const (
+	JWTAlgRS256 = "RS256"
+	JWTAlgES256 = "ES256"
+	JWTAlgEdDSA = "EdDSA"
+)
+
+// jwtLeeway is how much clock skew is tolerated when checking exp and nbf.
+const jwtLeeway = 30 * time.Second
+
+var (
+	ErrNoJWTKeys      = errors.New("No usable public keys found in the JWT key file")
+	ErrBadJWT         = errors.New("Malformed JWT")
+	ErrJWTAlg         = errors.New("JWT must be signed with RS256, ES256 or EdDSA")
+	ErrJWTSignature   = errors.New("JWT signature does not match any key")
+	ErrJWTExpired     = errors.New("JWT has expired")
+	ErrJWTNotYetValid = errors.New("JWT is not valid yet")
+	ErrJWTIssuer      = errors.New("JWT has the wrong issuer")
+	ErrJWTAudience    = errors.New("JWT is not intended for this audience")
+	ErrJWTNoUser      = errors.New("JWT does not name a valid user")
+	ErrJWTRoot        = errors.New("JWTs cannot be used to log in as root")
+)
+
+// jwtKey is a public key that can verify JWTs. ID and Alg are empty if the key
+// file does not give them, in which case the key is tried for all tokens it can
+// verify.
+type jwtKey struct {
+	ID  string
+	Alg string
+	Key crypto.PublicKey
+}
+
+// JWTAuth authenticates bearer tokens that are JWTs, signed by one of the
+// public keys in File, which is either a JWKS or a PEM file. The token's Claim
+// names the user, and if Issuer and Audience are not empty, the token's iss and
+// aud must match them. If ProvisionRole is not empty, users that don't exist
+// are created with that role on their first login.
+type JWTAuth struct {
+	File          string
+	Issuer        string
+	Audience      string
+	Claim         string
+	ProvisionRole string
+
+	mu      sync.RWMutex
+	keys    []jwtKey
+	modTime time.Time
+}
+
+func NewJWTAuth(file, issuer, audience, claim, provisionRole string) (*JWTAuth, error) {
+	if provisionRole != "" && !validRole(provisionRole) {
+		return nil, ErrBadRole
+	}
+	ja := &JWTAuth{
+		File:          file,
+		Issuer:        issuer,
+		Audience:      audience,
+		Claim:         claim,
+		ProvisionRole: provisionRole,
+	}
+	return ja, ja.Reload()
+}
+
+// Reload reads the keys from the key file again. If that fails, the old keys
+// are kept.
+func (ja *JWTAuth) Reload() error {
+	fi, err := os.Stat(ja.File)
+	if err != nil {
+		return err
+	}
+	bs, err := ioutil.ReadFile(ja.File)
+	if err != nil {
+		return err
+	}
+	var keys []jwtKey
+	if trimmed := bytes.TrimSpace(bs); len(trimmed) > 0 && trimmed[0] == '{' {
+		keys, err = parseJWKS(trimmed)
+	} else {
+		keys, err = parsePEMKeys(bs)
+	}
+	if err == nil && len(keys) == 0 {
+		err = ErrNoJWTKeys
+	}
+	ja.mu.Lock()
+	defer ja.mu.Unlock()
+	ja.modTime = fi.ModTime()
+	if err != nil {
+		return err
+	}
+	ja.keys = keys
+	return nil
+}
+
+// ReloadOnHangup reloads the keys whenever the process receives SIGHUP.
+func (ja *JWTAuth) ReloadOnHangup() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		err := ja.Reload()
+		if err != nil {
+			log.Errorf("Unable to reload JWT keys: %s", err)
+			continue
+		}
+		log.Infof("Reloaded JWT keys from %s", ja.File)
+	}
+}
+
+// currentKeys returns the keys, after reloading them if the key file has been
+// modified.
+func (ja *JWTAuth) currentKeys() []jwtKey {
+	ja.mu.RLock()
+	modTime := ja.modTime
+	ja.mu.RUnlock()
+	if fi, err := os.Stat(ja.File); err == nil && !fi.ModTime().Equal(modTime) {
+		err = ja.Reload()
+		if err != nil {
+			log.Errorf("Unable to reload JWT keys: %s", err)
+		} else {
+			log.Infof("Reloaded JWT keys from %s", ja.File)
+		}
+	}
+	ja.mu.RLock()
+	defer ja.mu.RUnlock()
+	return ja.keys
+}
+
+// Handles returns true if the bearer token should be verified as a JWT, which
+// is the case for everything but API tokens. A nil JWTAuth handles nothing.
+func (ja *JWTAuth) Handles(bearer string) bool {
+	return ja != nil && !strings.HasPrefix(bearer, tokenPrefix)
+}
+
+// Verify checks the signature and claims of the JWT, and returns the user it
+// names.
+func (ja *JWTAuth) Verify(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", ErrBadJWT
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	err := decodeJWTPart(parts[0], &header)
+	if err != nil {
+		return "", err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", ErrBadJWT
+	}
+	switch header.Alg {
+	case JWTAlgRS256, JWTAlgES256, JWTAlgEdDSA:
+	default:
+		return "", ErrJWTAlg
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, key := range ja.currentKeys() {
+		if (key.ID != "" && header.Kid != "" && key.ID != header.Kid) || (key.Alg != "" && key.Alg != header.Alg) {
+			continue
+		}
+		if verifyJWTSignature(header.Alg, key.Key, signed, sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return "", ErrJWTSignature
+	}
+
+	var claims map[string]interface{}
+	err = decodeJWTPart(parts[1], &claims)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.Add(-jwtLeeway).After(time.Unix(int64(exp), 0)) {
+		return "", ErrJWTExpired
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return "", ErrJWTNotYetValid
+	}
+	if iss, _ := claims["iss"].(string); ja.Issuer != "" && iss != ja.Issuer {
+		return "", ErrJWTIssuer
+	}
+	if ja.Audience != "" && !hasAudience(claims["aud"], ja.Audience) {
+		return "", ErrJWTAudience
+	}
+	user, _ := claims[ja.Claim].(string)
+	if user == "" || strings.Contains(user, "/") {
+		return "", ErrJWTNoUser
+	}
+	if user == "root" {
+		return "", ErrJWTRoot
+	}
+	return user, nil
+}
+
+// hasAudience returns true if the aud claim, which is either a string or a list
+// of strings, contains the audience.
+func hasAudience(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	bs, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil || json.Unmarshal(bs, v) != nil {
+		return ErrBadJWT
+	}
+	return nil
+}
+
+// verifyJWTSignature returns true if sig is a valid signature of signed by the
+// key, using the algorithm alg.
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed, sig []byte) bool {
+	switch alg {
+	case JWTAlgRS256:
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return false
+		}
+		sum := sha256.Sum256(signed)
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], sig) == nil
+	case JWTAlgES256:
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || pub.Curve != elliptic.P256() || len(sig) != 64 {
+			return false
+		}
+		sum := sha256.Sum256(signed)
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(pub, sum[:], r, s)
+	case JWTAlgEdDSA:
+		pub, ok := key.(ed25519.PublicKey)
+		return ok && ed25519.Verify(pub, signed, sig)
+	}
+	return false
+}
+
+// parseJWKS parses the signing keys in a JSON Web Key Set. Keys of unsupported
+// types are skipped.
+func parseJWKS(bs []byte) ([]jwtKey, error) {
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Alg string `json:"alg"`
+			Use string `json:"use"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	err := json.Unmarshal(bs, &set)
+	if err != nil {
+		return nil, err
+	}
+	var keys []jwtKey
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		var pub crypto.PublicKey
+		switch {
+		case k.Kty == "RSA":
+			n, e := decodeBigInt(k.N), decodeBigInt(k.E)
+			if n == nil || e == nil || !e.IsInt64() {
+				return nil, fmt.Errorf("Malformed RSA key %d in JWKS", i)
+			}
+			pub = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		case k.Kty == "EC" && k.Crv == "P-256":
+			x, y := decodeBigInt(k.X), decodeBigInt(k.Y)
+			if x == nil || y == nil || !elliptic.P256().IsOnCurve(x, y) {
+				return nil, fmt.Errorf("Malformed EC key %d in JWKS", i)
+			}
+			pub = &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		case k.Kty == "OKP" && k.Crv == "Ed25519":
+			x, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(k.X, "="))
+			if err != nil || len(x) != ed25519.PublicKeySize {
+				return nil, fmt.Errorf("Malformed Ed25519 key %d in JWKS", i)
+			}
+			pub = ed25519.PublicKey(x)
+		default:
+			continue
+		}
+		keys = append(keys, jwtKey{ID: k.Kid, Alg: k.Alg, Key: pub})
+	}
+	return keys, nil
+}
+
+func decodeBigInt(s string) *big.Int {
+	bs, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil || len(bs) == 0 {
+		return nil
+	}
+	return new(big.Int).SetBytes(bs)
+}
+
+// parsePEMKeys parses the public keys and certificates in a PEM file.
+func parsePEMKeys(bs []byte) ([]jwtKey, error) {
+	var keys []jwtKey
+	for {
+		var block *pem.Block
+		block, bs = pem.Decode(bs)
+		if block == nil {
+			return keys, nil
+		}
+		var pub crypto.PublicKey
+		var err error
+		switch block.Type {
+		case "PUBLIC KEY":
+			pub, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			pub, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			cert, err = x509.ParseCertificate(block.Bytes)
+			if err == nil {
+				pub = cert.PublicKey
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, jwtKey{Key: pub})
+	}
+}
+
+// authorizeJWT verifies the JWT and returns the user it names. If the user does
+// not exist and the JWT auth provisions users, it is created.
+func (db DB) authorizeJWT(token string) (string, error) {
+	name, err := db.JWT.Verify(token)
+	if err != nil {
+		log.Warnf("Rejected JWT: %s", err)
+		return "", ErrUnauthorized
+	}
+	if db.JWT.ProvisionRole == "" {
+		return name, nil
+	}
+	exists := false
+	err = db.View(func(tx *bolt.Tx) error {
+		exists = tx.Bucket(userBucket).Get([]byte(name)) != nil
+		return nil
+	})
+	if err != nil || exists {
+		return name, err
+	}
+	return name, db.Update(func(tx *bolt.Tx) error {
+		users := tx.Bucket(userBucket)
+		if users.Get([]byte(name)) != nil {
+			return nil
+		}
+		log.Infof("Provisioning user %s with the role %s from a JWT", name, db.JWT.ProvisionRole)
+		u := User{
+			Roles:       []string{db.JWT.ProvisionRole},
+			Created:     time.Now().UTC(),
+			Description: "Provisioned from a JWT",
+		}
+		return users.Put([]byte(name), u.Marshal())
+	})
+}
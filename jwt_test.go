@@ -0,0 +1,301 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	log "github.com/sirupsen/logrus"
+)
+
+// testJWTKey is a private key that signs JWTs in tests.
+type testJWTKey struct {
+	alg string
+	kid string
+	key crypto.Signer
+}
+
+func newTestJWTKey(t *testing.T, alg, kid string) testJWTKey {
+	var key crypto.Signer
+	var err error
+	switch alg {
+	case JWTAlgRS256:
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	case JWTAlgES256:
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case JWTAlgEdDSA:
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testJWTKey{alg: alg, kid: kid, key: key}
+}
+
+// jwk returns the public key as a JSON Web Key.
+func (k testJWTKey) jwk() map[string]string {
+	b64 := base64.RawURLEncoding.EncodeToString
+	jwk := map[string]string{"kid": k.kid, "alg": k.alg, "use": "sig"}
+	switch pub := k.key.Public().(type) {
+	case *rsa.PublicKey:
+		jwk["kty"] = "RSA"
+		jwk["n"] = b64(pub.N.Bytes())
+		jwk["e"] = b64(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		jwk["kty"], jwk["crv"] = "EC", "P-256"
+		jwk["x"] = b64(pub.X.FillBytes(make([]byte, 32)))
+		jwk["y"] = b64(pub.Y.FillBytes(make([]byte, 32)))
+	case ed25519.PublicKey:
+		jwk["kty"], jwk["crv"] = "OKP", "Ed25519"
+		jwk["x"] = b64(pub)
+	}
+	return jwk
+}
+
+// sign returns a JWT with the claims, signed by the key.
+func (k testJWTKey) sign(t *testing.T, claims map[string]interface{}) string {
+	signed := jwtPayload(t, map[string]interface{}{"alg": k.alg, "kid": k.kid}, claims)
+	var sig []byte
+	var err error
+	switch key := k.key.(type) {
+	case *rsa.PrivateKey:
+		sum := sha256.Sum256([]byte(signed))
+		sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	case *ecdsa.PrivateKey:
+		sum := sha256.Sum256([]byte(signed))
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, key, sum[:])
+		if err == nil {
+			sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(key, []byte(signed))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// jwtPayload returns the encoded header and claims of a JWT.
+func jwtPayload(t *testing.T, header, claims map[string]interface{}) string {
+	h, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+}
+
+// writeJWKS writes the public keys to the file as a JWKS.
+func writeJWKS(t *testing.T, path string, keys ...testJWTKey) {
+	var set struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	for _, k := range keys {
+		set.Keys = append(set.Keys, k.jwk())
+	}
+	bs, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path, bs, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// validClaims returns the claims of a token for bob that the JWTAuth made by
+// newTestJWTAuth accepts.
+func validClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"sub": "bob",
+		"iss": "https://issuer.example",
+		"aud": []string{"other", "valheap"},
+		"exp": time.Now().Add(time.Hour).Unix(),
+		"nbf": time.Now().Add(-time.Minute).Unix(),
+	}
+}
+
+// newTestJWTAuth returns a JWTAuth trusting the keys, with the issuer and
+// audience of validClaims.
+func newTestJWTAuth(t *testing.T, keys ...testJWTKey) *JWTAuth {
+	log.SetOutput(ioutil.Discard)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, path, keys...)
+	ja, err := NewJWTAuth(path, "https://issuer.example", "valheap", "sub", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ja
+}
+
+func TestJWTSignatures(t *testing.T) {
+	for _, alg := range []string{JWTAlgRS256, JWTAlgES256, JWTAlgEdDSA} {
+		key, other := newTestJWTKey(t, alg, "key"), newTestJWTKey(t, alg, "key")
+		unknown := newTestJWTKey(t, alg, "unknown")
+		ja := newTestJWTAuth(t, key)
+		tests := []struct {
+			name  string
+			token string
+			err   error
+		}{
+			{"valid", key.sign(t, validClaims()), nil},
+			{"bad signature", other.sign(t, validClaims()), ErrJWTSignature},
+			{"unknown kid", unknown.sign(t, validClaims()), ErrJWTSignature},
+		}
+		for _, tc := range tests {
+			user, err := ja.Verify(tc.token)
+			if err != tc.err || (err == nil && user != "bob") {
+				t.Errorf("%s, %s: expected %v, got %q, %v", alg, tc.name, tc.err, user, err)
+			}
+		}
+	}
+}
+
+func TestJWTAlgorithms(t *testing.T) {
+	key := newTestJWTKey(t, JWTAlgRS256, "key")
+	ja := newTestJWTAuth(t, key)
+	der, err := x509.MarshalPKIXPublicKey(key.key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+	none := jwtPayload(t, map[string]interface{}{"alg": "none", "kid": "key"}, validClaims()) + "."
+	signed := jwtPayload(t, map[string]interface{}{"alg": "HS256", "kid": "key"}, validClaims())
+	mac := hmac.New(sha256.New, pub)
+	mac.Write([]byte(signed))
+	hs256 := signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+
+	for name, token := range map[string]string{"none": none, "HS256 with the public key": hs256} {
+		if user, err := ja.Verify(token); err != ErrJWTAlg {
+			t.Errorf("alg %s: expected %v, got %q, %v", name, ErrJWTAlg, user, err)
+		}
+	}
+}
+
+func TestJWTClaims(t *testing.T) {
+	key := newTestJWTKey(t, JWTAlgES256, "key")
+	ja := newTestJWTAuth(t, key)
+	tests := []struct {
+		name  string
+		claim string
+		value interface{}
+		err   error
+	}{
+		{"expired", "exp", time.Now().Add(-time.Hour).Unix(), ErrJWTExpired},
+		{"within the leeway", "exp", time.Now().Add(-jwtLeeway / 2).Unix(), nil},
+		{"missing exp", "exp", nil, ErrJWTExpired},
+		{"not yet valid", "nbf", time.Now().Add(time.Hour).Unix(), ErrJWTNotYetValid},
+		{"wrong iss", "iss", "https://evil.example", ErrJWTIssuer},
+		{"missing iss", "iss", nil, ErrJWTIssuer},
+		{"wrong aud", "aud", "other", ErrJWTAudience},
+		{"missing aud", "aud", nil, ErrJWTAudience},
+		{"single aud", "aud", "valheap", nil},
+		{"missing sub", "sub", nil, ErrJWTNoUser},
+		{"root", "sub", "root", ErrJWTRoot},
+	}
+	for _, tc := range tests {
+		claims := validClaims()
+		if tc.value == nil {
+			delete(claims, tc.claim)
+		} else {
+			claims[tc.claim] = tc.value
+		}
+		user, err := ja.Verify(key.sign(t, claims))
+		if err != tc.err {
+			t.Errorf("%s: expected %v, got %q, %v", tc.name, tc.err, user, err)
+		}
+	}
+}
+
+func TestJWTReloadOnModification(t *testing.T) {
+	old, rotated := newTestJWTKey(t, JWTAlgEdDSA, "old"), newTestJWTKey(t, JWTAlgEdDSA, "new")
+	ja := newTestJWTAuth(t, old)
+	token := rotated.sign(t, validClaims())
+	if _, err := ja.Verify(token); err != ErrJWTSignature {
+		t.Fatalf("Expected a token signed by an unknown key to be rejected, got %v", err)
+	}
+
+	writeJWKS(t, ja.File, rotated)
+	// Make sure the modification time changes, even on file systems with
+	// coarse timestamps.
+	mtime := time.Now().Add(time.Minute)
+	err := os.Chtimes(ja.File, mtime, mtime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ja.Verify(token); err != nil {
+		t.Errorf("Expected the rotated key to be loaded, got %v", err)
+	}
+	if _, err := ja.Verify(old.sign(t, validClaims())); err != ErrJWTSignature {
+		t.Errorf("Expected the old key to be dropped, got %v", err)
+	}
+
+	// A broken key file keeps the old keys.
+	err = ioutil.WriteFile(ja.File, []byte("{"), 0600)
+	if err == nil {
+		mtime = mtime.Add(time.Minute)
+		err = os.Chtimes(ja.File, mtime, mtime)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ja.Verify(token); err != nil {
+		t.Errorf("Expected the keys to be kept when the key file is broken, got %v", err)
+	}
+}
+
+func TestJWTProvisionedUsersHaveNoPassword(t *testing.T) {
+	key := newTestJWTKey(t, JWTAlgRS256, "key")
+	db := newTestDB(t)
+	db.JWT = newTestJWTAuth(t, key)
+	db.JWT.ProvisionRole = RoleReader
+	_, err := db.Put(DefaultNamespace, "key", []byte("value"), WriteOptions{Author: "root"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := key.sign(t, validClaims())
+	if w := serve(db, "GET", "/val/key", nil, bearerAuth(token)); w.Code != http.StatusOK {
+		t.Fatalf("Expected the JWT to provision bob, got %d: %s", w.Code, w.Body)
+	}
+	var u *User
+	err = db.View(func(tx *bolt.Tx) (err error) {
+		u, err = UnmarshalRawUser(tx.Bucket(userBucket).Get([]byte("bob")))
+		return
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.HashPass != "" {
+		t.Fatalf("Expected the provisioned user to have no password, got %q", u.HashPass)
+	}
+	for _, pass := range []string{"", testPassword} {
+		auth := func(r *http.Request) { r.SetBasicAuth("bob", pass) }
+		if w := serve(db, "GET", "/val/key", nil, auth); w.Code != http.StatusUnauthorized {
+			t.Errorf("Basic auth as the provisioned user with password %q: expected 401, got %d", pass, w.Code)
+		}
+	}
+}
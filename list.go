@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// ListOptions selects the keys to list. Only keys starting with Prefix are
+// listed. StartAfter and End are exclusive bounds: Keys are listed from (but not
+// including) StartAfter, and up to (but not including) End. If Reverse is true,
+// keys are listed in descending order, so that StartAfter is an upper bound and
+// End a lower bound. If Limit is positive, at most that many keys are listed.
+// If WithMeta is true, the metadata of each key is read as well. If Filter is
+// non-nil, only keys it returns true for are listed.
+type ListOptions struct {
+	Prefix     string
+	StartAfter string
+	End        string
+	Reverse    bool
+	Limit      int
+	WithMeta   bool
+	Filter     func(key []byte) bool
+}
+
+// prefixEnd returns the smallest key greater than all keys with the prefix, or
+// nil if there is no such key.
+func prefixEnd(prefix []byte) []byte {
+	end := copyBytes(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// seekBefore moves the cursor to the greatest key less than key, or to the last
+// key if key is nil.
+func seekBefore(c *bolt.Cursor, key []byte) (k []byte) {
+	if key == nil {
+		k, _ = c.Last()
+		return
+	}
+	k, _ = c.Seek(key)
+	if k == nil {
+		k, _ = c.Last()
+	} else {
+		k, _ = c.Prev()
+	}
+	return
+}
+
+// first moves the cursor to the first key to list.
+func (opts ListOptions) first(c *bolt.Cursor) (k []byte) {
+	prefix, startAfter := []byte(opts.Prefix), []byte(opts.StartAfter)
+	if opts.Reverse {
+		upper := prefixEnd(prefix)
+		if len(startAfter) > 0 && (upper == nil || bytes.Compare(startAfter, upper) < 0) {
+			upper = startAfter
+		}
+		return seekBefore(c, upper)
+	}
+	if len(startAfter) > 0 && bytes.Compare(startAfter, prefix) >= 0 {
+		k, _ = c.Seek(startAfter)
+		if bytes.Equal(k, startAfter) {
+			k, _ = c.Next()
+		}
+		return
+	}
+	k, _ = c.Seek(prefix)
+	return
+}
+
+// inRange returns true if the key is within the prefix and End bound.
+func (opts ListOptions) inRange(k []byte) bool {
+	if k == nil || !bytes.HasPrefix(k, []byte(opts.Prefix)) {
+		return false
+	}
+	if opts.End == "" {
+		return true
+	}
+	cmp := bytes.Compare(k, []byte(opts.End))
+	return (!opts.Reverse && cmp < 0) || (opts.Reverse && cmp > 0)
+}
+
+// listKeys calls fn with each live key in the namespace selected by opts, and
+// returns the last key listed if there are more keys remaining, which can only
+// happen with a limit. It stops after the first key past the limit. fn may be
+// nil.
+func listKeys(ns buckets, opts ListOptions, fn func(key []byte, m *Meta) error) (next []byte, err error) {
+	now := time.Now()
+	c := ns.Bucket(valueBucket).Cursor()
+	step := c.Next
+	if opts.Reverse {
+		step = c.Prev
+	}
+	var last []byte
+	n := 0
+	for k := opts.first(c); opts.inRange(k); k, _ = step() {
+		if isExpired(expiresAt(ns, k), now) || (opts.Filter != nil && !opts.Filter(k)) {
+			continue
+		}
+		if opts.Limit > 0 && n == opts.Limit {
+			return last, nil
+		}
+		if fn != nil {
+			var m *Meta
+			if opts.WithMeta {
+				m, err = getMeta(ns, k)
+				if err != nil {
+					return nil, err
+				}
+			}
+			err = fn(k, m)
+			if err != nil {
+				return nil, err
+			}
+		}
+		last = k
+		n++
+	}
+	return nil, nil
+}
+
+// List calls fn with each key in the namespace selected by opts, along with its
+// metadata if requested. The keys are read straight from the database, and are
+// only valid until fn returns. Before any key is listed, begin is called with
+// the key to pass as StartAfter to list the next page, or nil if there are no
+// more keys after this page. Finding it takes a pass over the page before
+// listing it, so it is only done if the page has a limit.
+func (db DB) List(namespaceName string, opts ListOptions, begin func(next []byte), fn func(key []byte, m *Meta) error) error {
+	return db.View(func(tx *bolt.Tx) error {
+		ns := namespace(tx, namespaceName)
+		if ns == nil {
+			begin(nil)
+			return nil
+		}
+		var next []byte
+		if opts.Limit > 0 {
+			var err error
+			next, err = listKeys(ns, opts, nil)
+			if err != nil {
+				return err
+			}
+		}
+		begin(next)
+		_, err := listKeys(ns, opts, fn)
+		return err
+	})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var metaBucket = []byte(`meta`)
+
+// Meta is the metadata stored for each key. Keys written before metadata was
+// introduced have none.
+type Meta struct {
+	Created     time.Time
+	Modified    time.Time
+	ModifiedBy  string
+	ContentType string `json:",omitempty"`
+	Size        int
+	// Owner is the user that created the key, whose quota the key counts
+	// against. Keys created before quotas existed have no owner.
+	Owner string `json:",omitempty"`
+}
+
+// getMeta returns the metadata of the key, or nil if it has none.
+func getMeta(ns buckets, key []byte) (*Meta, error) {
+	bs := ns.Bucket(metaBucket).Get(key)
+	if bs == nil {
+		return nil, nil
+	}
+	var m Meta
+	if json.Unmarshal(bs, &m) != nil {
+		return nil, ErrDBCorrupted
+	}
+	return &m, nil
+}
+
+// updateMeta records that the key was set to val by the write. If prev is nil,
+// the key is considered to be created by it, and otherwise its content type is
+// kept unless the write has one.
+func updateMeta(ns buckets, key, prev, val []byte, opts WriteOptions) error {
+	now := time.Now().UTC()
+	owner, err := keyOwner(ns, key, prev, opts.Author)
+	if err != nil {
+		return err
+	}
+	m := Meta{Created: now, Owner: owner}
+	if prev != nil {
+		old, err := getMeta(ns, key)
+		if err != nil {
+			return err
+		}
+		if old != nil {
+			m.Created = old.Created
+			m.ContentType = old.ContentType
+		}
+	}
+	m.Modified = now
+	m.ModifiedBy = opts.Author
+	if opts.ContentType != "" {
+		m.ContentType = opts.ContentType
+	}
+	m.Size = len(val)
+	bs, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return ns.Bucket(metaBucket).Put(key, bs)
+}
+
+// KeyMeta is a key along with its metadata, if any.
+type KeyMeta struct {
+	Key  string
+	Meta *Meta
+}
+
+// GetMeta returns the metadata of the key in the namespace, or nil if there is
+// no such key. If the key exists but has no metadata, Meta is nil.
+func (db DB) GetMeta(namespaceName, key string) (km *KeyMeta, err error) {
+	err = db.View(func(tx *bolt.Tx) error {
+		ns := namespace(tx, namespaceName)
+		if ns == nil || liveValue(ns, []byte(key)) == nil {
+			return nil
+		}
+		m, err := getMeta(ns, []byte(key))
+		if err != nil {
+			return err
+		}
+		km = &KeyMeta{Key: key, Meta: m}
+		return nil
+	})
+	return
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultNamespace is the namespace used when none is specified. Its data is
+// stored in the top-level buckets, so that databases created before namespaces
+// existed keep working.
+const DefaultNamespace = "default"
+
+var namespaceBucket = []byte(`namespaces`)
+
+var (
+	ErrNamespaceNotExists = errors.New("Namespace does not exist")
+	ErrNamespaceExists    = errors.New("Namespace already exists")
+	ErrCannotDropDefault  = errors.New("Cannot drop the default namespace")
+	ErrBadNamespace       = errors.New("Namespace names must be nonempty and cannot contain '/'")
+)
+
+// namespaceBuckets are the buckets every namespace contains.
+var namespaceBuckets = [][]byte{valueBucket, expiryBucket, expiryIndexBucket, historyBucket, metaBucket, usageBucket}
+
+// buckets holds the buckets of a namespace. It is either a *bolt.Tx for the
+// default namespace, or the namespace's *bolt.Bucket inside the namespaces
+// bucket.
+type buckets interface {
+	Bucket(name []byte) *bolt.Bucket
+	CreateBucketIfNotExists(name []byte) (*bolt.Bucket, error)
+}
+
+func validNamespace(name string) error {
+	if name == "" || strings.Contains(name, "/") {
+		return ErrBadNamespace
+	}
+	return nil
+}
+
+// namespace returns the buckets of the namespace, or nil if it doesn't exist.
+func namespace(tx *bolt.Tx, name string) buckets {
+	if name == DefaultNamespace {
+		return tx
+	}
+	bucket := tx.Bucket(namespaceBucket).Bucket([]byte(name))
+	if bucket == nil {
+		return nil
+	}
+	return bucket
+}
+
+// ensureNamespace returns the buckets of the namespace, creating it if it
+// doesn't exist.
+func ensureNamespace(tx *bolt.Tx, name string) (buckets, error) {
+	err := validNamespace(name)
+	if err != nil {
+		return nil, err
+	}
+	var ns buckets = tx
+	if name != DefaultNamespace {
+		bucket, err := tx.Bucket(namespaceBucket).CreateBucketIfNotExists([]byte(name))
+		if err != nil {
+			return nil, err
+		}
+		ns = bucket
+	}
+	for _, name := range namespaceBuckets {
+		_, err := ns.CreateBucketIfNotExists(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ns, nil
+}
+
+// forEachNamespace calls fn with every namespace in the database, starting with
+// the default namespace.
+func forEachNamespace(tx *bolt.Tx, fn func(name string, ns buckets) error) error {
+	err := fn(DefaultNamespace, tx)
+	if err != nil {
+		return err
+	}
+	c := tx.Bucket(namespaceBucket).Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if v != nil {
+			continue // not a bucket
+		}
+		err = fn(string(k), tx.Bucket(namespaceBucket).Bucket(k))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateNamespace creates a new, empty namespace. Only admins can do this.
+func (db DB) CreateNamespace(caller *Identity, ns string) error {
+	if !caller.IsAdmin() {
+		return ErrForbiddenRoot
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		if namespace(tx, ns) != nil {
+			return ErrNamespaceExists
+		}
+		_, err := ensureNamespace(tx, ns)
+		return err
+	})
+}
+
+// DropNamespace deletes a namespace along with all its keys, which stop counting
+// towards their owners' quotas. Only admins can do this, and the default
+// namespace cannot be dropped.
+func (db DB) DropNamespace(caller *Identity, ns string) error {
+	if !caller.IsAdmin() {
+		return ErrForbiddenRoot
+	}
+	if ns == DefaultNamespace {
+		return ErrCannotDropDefault
+	}
+	released := map[string]Usage{}
+	err := db.Update(func(tx *bolt.Tx) error {
+		nsBuckets := namespace(tx, ns)
+		if nsBuckets == nil {
+			return ErrNamespaceNotExists
+		}
+		err := nsBuckets.Bucket(usageBucket).ForEach(func(k, _ []byte) error {
+			u, err := getUsage(nsBuckets, string(k))
+			released[string(k)] = u
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(namespaceBucket).DeleteBucket([]byte(ns))
+	})
+	if err != nil {
+		return err
+	}
+	for owner, u := range released {
+		log.Infof("Dropping namespace %s released %d keys and %d bytes owned by %s", ns, u.Keys, u.Bytes, owner)
+	}
+	return nil
+}
+
+func (db DB) ListNamespaces(caller *Identity) (names []string, err error) {
+	if !caller.IsAdmin() {
+		return nil, ErrForbiddenRoot
+	}
+	err = db.View(func(tx *bolt.Tx) error {
+		return forEachNamespace(tx, func(name string, _ buckets) error {
+			names = append(names, name)
+			return nil
+		})
+	})
+	return
+}
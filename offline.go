@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// offlineUsage describes the commands that operate directly on the database
+// file while the server is stopped.
+const offlineUsage = `Commands, run instead of the server:
+
+  reset-password USER  Gives the user a new random password, which must be
+                       changed on the next login
+  list-users           Lists all users with their roles and groups
+  dump                 Writes all keys and values to stdout as JSON lines
+  load                 Reads keys and values from stdin as written by dump
+  stats                Prints the number of users, namespaces and keys`
+
+var ErrUnknownCommand = errors.New("Unknown command")
+
+// DumpEntry is a key and its value, as written by dump and read by load.
+type DumpEntry struct {
+	Namespace string
+	Key       string
+	Value     []byte
+	Expires   *time.Time `json:",omitempty"`
+	Meta      *Meta      `json:",omitempty"`
+}
+
+// RunCommand runs an offline command with its arguments.
+func (db DB) RunCommand(args []string) error {
+	switch {
+	case args[0] == "reset-password" && len(args) == 2:
+		pass, err := db.ResetPassword(args[1])
+		if err == nil {
+			fmt.Printf("New password for %s: %s\n", args[1], pass)
+		}
+		return err
+	case args[0] == "list-users" && len(args) == 1:
+		return db.WriteUsers(os.Stdout)
+	case args[0] == "dump" && len(args) == 1:
+		return db.Dump(os.Stdout)
+	case args[0] == "load" && len(args) == 1:
+		n, err := db.Load(os.Stdin)
+		if err == nil {
+			fmt.Printf("Loaded %d keys\n", n)
+		}
+		return err
+	case args[0] == "stats" && len(args) == 1:
+		return db.WriteStats(os.Stdout)
+	}
+	return ErrUnknownCommand
+}
+
+// ResetPassword gives the user a new random password, which the user must
+// change before doing anything else, and returns it.
+func (db DB) ResetPassword(name string) (pass string, err error) {
+	pass = base64.RawURLEncoding.EncodeToString(randomBytes(18))
+	var tmp User
+	err = db.Hasher.SetPassword(&tmp, pass)
+	if err != nil {
+		return "", err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		return updateUser(tx, name, func(u *User) error {
+			u.HashPass, u.HashAlgo, u.HashCost = tmp.HashPass, tmp.HashAlgo, tmp.HashCost
+			u.MustChangePassword = true
+			return nil
+		})
+	})
+	return
+}
+
+// WriteUsers writes all users, one per line, as the username, the comma
+// separated roles (* for root) and the comma separated groups separated by tabs.
+func (db DB) WriteUsers(w io.Writer) error {
+	return db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(userBucket).ForEach(func(k, v []byte) error {
+			u, err := UnmarshalRawUser(v)
+			if err != nil {
+				return ErrDBCorrupted
+			}
+			roles := strings.Join(u.Roles, ",")
+			switch {
+			case string(k) == "root":
+				roles = "*"
+			case u.Roles == nil && u.Groups == nil:
+				roles = strings.Join(defaultRoles, ",")
+			}
+			_, err = fmt.Fprintf(w, "%s\t%s\t%s\n", k, roles, strings.Join(u.Groups, ","))
+			return err
+		})
+	})
+}
+
+// Dump writes every live key in every namespace to w as JSON lines.
+func (db DB) Dump(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	now := time.Now()
+	return db.View(func(tx *bolt.Tx) error {
+		return forEachNamespace(tx, func(name string, ns buckets) error {
+			return ns.Bucket(valueBucket).ForEach(func(k, v []byte) error {
+				e := DumpEntry{Namespace: name, Key: string(k), Value: v}
+				if expires := expiresAt(ns, k); !expires.IsZero() {
+					if isExpired(expires, now) {
+						return nil
+					}
+					e.Expires = &expires
+				}
+				var err error
+				e.Meta, err = getMeta(ns, k)
+				if err != nil {
+					return err
+				}
+				return enc.Encode(e)
+			})
+		})
+	})
+}
+
+// Load reads JSON lines written by Dump from r and stores them in a single
+// transaction, replacing existing keys. The keys are restored as they were, so
+// they are neither checked against quotas nor archived in the history, though
+// they still count towards their owners' usage. It returns the number of keys
+// stored.
+func (db DB) Load(r io.Reader) (n int, err error) {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	err = db.Update(func(tx *bolt.Tx) error {
+		for {
+			var e DumpEntry
+			err := dec.Decode(&e)
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("Entry %d: %s", n+1, err)
+			}
+			if e.Namespace == "" {
+				e.Namespace = DefaultNamespace
+			}
+			ns, err := ensureNamespace(tx, e.Namespace)
+			if err != nil {
+				return fmt.Errorf("Entry %d: %s", n+1, err)
+			}
+			if e.Expires != nil && isExpired(*e.Expires, time.Now()) {
+				continue
+			}
+			owner := ""
+			if e.Meta != nil {
+				if e.Meta.Owner == "" {
+					e.Meta.Owner = e.Meta.ModifiedBy
+				}
+				owner = e.Meta.Owner
+			}
+			key := []byte(e.Key)
+			err = removeKey(ns, key)
+			if err == nil {
+				err = ns.Bucket(valueBucket).Put(key, e.Value)
+			}
+			if err == nil {
+				err = addUsage(ns, owner, 1, int64(len(e.Value)), false)
+			}
+			if err == nil && e.Expires != nil {
+				err = expireAt(ns, key, *e.Expires)
+			}
+			if err == nil && e.Meta != nil {
+				// Keep the metadata as it was, including its times and owner.
+				bs, _ := json.Marshal(e.Meta)
+				err = ns.Bucket(metaBucket).Put(key, bs)
+			}
+			if err != nil {
+				return err
+			}
+			n++
+		}
+	})
+	return
+}
+
+// WriteStats writes the number of users, groups, tokens and namespaces to w,
+// along with the number of keys and their total size in each namespace.
+func (db DB) WriteStats(w io.Writer) error {
+	return db.View(func(tx *bolt.Tx) error {
+		for _, b := range []struct {
+			name   string
+			bucket []byte
+		}{{"users", userBucket}, {"groups", groupBucket}, {"tokens", tokenBucket}} {
+			fmt.Fprintf(w, "%s\t%d\n", b.name, tx.Bucket(b.bucket).Stats().KeyN)
+		}
+		var namespaces int
+		err := forEachNamespace(tx, func(name string, ns buckets) error {
+			var keys, size int
+			err := ns.Bucket(valueBucket).ForEach(func(k, v []byte) error {
+				keys++
+				size += len(v)
+				return nil
+			})
+			namespaces++
+			fmt.Fprintf(w, "namespace %s\t%d keys\t%d bytes\n", name, keys, size)
+			return err
+		})
+		fmt.Fprintf(w, "namespaces\t%d\n", namespaces)
+		fmt.Fprintf(w, "file size\t%d bytes\n", tx.Size())
+		return err
+	})
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestLoadBypassesQuotaAndHistory(t *testing.T) {
+	src := newTestDB(t)
+	addTestUser(t, src, "bob")
+	for _, key := range []string{"a", "b"} {
+		_, err := src.Put(DefaultNamespace, key, []byte("value"), WriteOptions{Author: "bob", ContentType: "text/plain"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var dump bytes.Buffer
+	err := src.Dump(&dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := newTestDB(t)
+	db.HistoryLimit = 10
+	addTestUser(t, db, "bob")
+	root := &Identity{Name: "root", Roles: []string{RoleAdmin}}
+	err = db.SetQuota(root, "bob", Quota{MaxKeys: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Put(DefaultNamespace, "a", []byte("old"), WriteOptions{Author: "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := db.Load(&dump)
+	if err != nil || n != 2 {
+		t.Fatalf("Expected 2 keys loaded, got %d (%v)", n, err)
+	}
+	revs, err := db.History(DefaultNamespace, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revs) != 0 {
+		t.Errorf("Expected no history from the load, got %d revisions", len(revs))
+	}
+	if ct := contentType(t, db, "a"); ct != "text/plain" {
+		t.Errorf("Expected the content type from the dump, got %q", ct)
+	}
+	info, err := db.QuotaInfo(root, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Usage != (Usage{Keys: 2, Bytes: 10}) {
+		t.Errorf("Expected the loaded keys to count towards bob's usage, got %+v", info.Usage)
+	}
+}
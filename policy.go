@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// The reasons a password can be rejected for, sent in the X-Valheap-Reason
+// header.
+const (
+	ReasonTooShort      = "too-short"
+	ReasonContainsUser  = "contains-username"
+	ReasonDenylisted    = "denylisted"
+	ReasonTooFewClasses = "too-few-character-classes"
+)
+
+// minContainedUsername is the shortest username passwords must not contain.
+// Shorter usernames are only rejected as the whole password, as nearly every
+// password contains a username like "e".
+const minContainedUsername = 4
+
+// PolicyError is returned for passwords that do not satisfy the password
+// policy.
+type PolicyError struct {
+	Reason  string
+	Message string
+}
+
+func (pe *PolicyError) Error() string {
+	return pe.Message
+}
+
+// PasswordPolicy is the requirements new passwords must satisfy. Passwords
+// must be at least MinLength characters long, must not contain the username (or
+// be it, for short usernames) and must not be in Denylist (compared case
+// insensitively). If Classes is positive, they must also contain characters
+// from at least that many of the classes lowercase letters, uppercase letters,
+// digits and other characters.
+type PasswordPolicy struct {
+	MinLength int
+	Denylist  map[string]bool
+	Classes   int
+}
+
+// LoadDenylist reads a file of passwords to deny, one per line.
+func LoadDenylist(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	denylist := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			denylist[strings.ToLower(line)] = true
+		}
+	}
+	return denylist, scanner.Err()
+}
+
+// characterClasses returns the number of character classes in the password.
+func characterClasses(pass string) int {
+	var lower, upper, digit, other int
+	for _, r := range pass {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+	return lower + upper + digit + other
+}
+
+// Check returns a PolicyError if the password for the user does not satisfy
+// the policy. A nil policy only rejects empty passwords.
+func (p *PasswordPolicy) Check(user, pass string) error {
+	if p == nil {
+		p = &PasswordPolicy{MinLength: 1}
+	}
+	if len([]rune(pass)) < p.MinLength || pass == "" {
+		return &PolicyError{ReasonTooShort, "Password is too short"}
+	}
+	lower, luser := strings.ToLower(pass), strings.ToLower(user)
+	if user != "" && lower == luser {
+		return &PolicyError{ReasonContainsUser, "Password must not be the username"}
+	}
+	if len([]rune(user)) >= minContainedUsername && strings.Contains(lower, luser) {
+		return &PolicyError{ReasonContainsUser, "Password must not contain the username"}
+	}
+	if p.Denylist[lower] {
+		return &PolicyError{ReasonDenylisted, "Password is too common"}
+	}
+	if characterClasses(pass) < p.Classes {
+		return &PolicyError{ReasonTooFewClasses, "Password must contain more kinds of characters (lowercase, uppercase, digits and others)"}
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// usageBucket holds the number of keys and bytes owned by each user in a
+// namespace.
+var usageBucket = []byte(`usage`)
+
+var (
+	ErrKeyQuotaExceeded  = errors.New("Quota exceeded: The owner of the key cannot store more keys")
+	ErrByteQuotaExceeded = errors.New("Quota exceeded: The owner of the key cannot store more bytes")
+	ErrBadQuota          = errors.New("Quota limits must be nonnegative integers")
+)
+
+// Quota is the most keys and bytes a user may own across all namespaces. Zero
+// means no limit.
+type Quota struct {
+	MaxKeys  int
+	MaxBytes int64
+}
+
+// Usage is the number of keys and bytes owned by a user.
+type Usage struct {
+	Keys  int
+	Bytes int64
+}
+
+// QuotaInfo is the quota of a user along with its current usage, in total and
+// per namespace.
+type QuotaInfo struct {
+	User string
+	Quota
+	Usage
+	Namespaces map[string]Usage
+}
+
+// txOf returns the transaction the namespace's buckets belong to.
+func txOf(ns buckets) *bolt.Tx {
+	if b, ok := ns.(*bolt.Bucket); ok {
+		return b.Tx()
+	}
+	return ns.(*bolt.Tx)
+}
+
+func getUsage(ns buckets, owner string) (u Usage, err error) {
+	bs := ns.Bucket(usageBucket).Get([]byte(owner))
+	if bs != nil && json.Unmarshal(bs, &u) != nil {
+		err = ErrDBCorrupted
+	}
+	return
+}
+
+// totalUsage returns the usage of the owner across all namespaces.
+func totalUsage(tx *bolt.Tx, owner string) (total Usage, perNs map[string]Usage, err error) {
+	perNs = map[string]Usage{}
+	err = forEachNamespace(tx, func(name string, ns buckets) error {
+		u, err := getUsage(ns, owner)
+		if u != (Usage{}) {
+			perNs[name] = u
+			total.Keys += u.Keys
+			total.Bytes += u.Bytes
+		}
+		return err
+	})
+	return
+}
+
+// addUsage adds keys and bytes to the owner's usage in the namespace. If check
+// is true and the owner would exceed its quota, nothing is changed and an error
+// is returned.
+func addUsage(ns buckets, owner string, keys int, bytes int64, check bool) error {
+	if owner == "" || (keys == 0 && bytes == 0) {
+		return nil
+	}
+	if check && (keys > 0 || bytes > 0) {
+		err := checkQuota(txOf(ns), owner, keys, bytes)
+		if err == ErrKeyQuotaExceeded || err == ErrByteQuotaExceeded {
+			// Expired keys that have not been reaped yet must not count.
+			err = releaseExpired(txOf(ns), owner)
+			if err == nil {
+				err = checkQuota(txOf(ns), owner, keys, bytes)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	usage, err := getUsage(ns, owner)
+	if err != nil {
+		return err
+	}
+	usage.Keys += keys
+	usage.Bytes += bytes
+	if usage == (Usage{}) {
+		return ns.Bucket(usageBucket).Delete([]byte(owner))
+	}
+	bs, err := json.Marshal(usage)
+	if err != nil {
+		return err
+	}
+	return ns.Bucket(usageBucket).Put([]byte(owner), bs)
+}
+
+// checkQuota returns an error if adding keys and bytes to the owner's usage
+// would exceed its quota.
+func checkQuota(tx *bolt.Tx, owner string, keys int, bytes int64) error {
+	u, err := getUser(tx, owner)
+	if err == ErrUserNotExists || (err == nil && u.Quota == nil) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	total, _, err := totalUsage(tx, owner)
+	if err != nil {
+		return err
+	}
+	if u.Quota.MaxKeys > 0 && keys > 0 && total.Keys+keys > u.Quota.MaxKeys {
+		return ErrKeyQuotaExceeded
+	}
+	if u.Quota.MaxBytes > 0 && bytes > 0 && total.Bytes+bytes > u.Quota.MaxBytes {
+		return ErrByteQuotaExceeded
+	}
+	return nil
+}
+
+// releaseExpired removes the owner's expired keys that have not been reaped
+// yet, which releases their usage.
+func releaseExpired(tx *bolt.Tx, owner string) error {
+	now := time.Now()
+	return forEachNamespace(tx, func(_ string, ns buckets) error {
+		for _, key := range expiredKeys(ns, now, 0) {
+			m, err := getMeta(ns, key)
+			if err == nil && m != nil && m.Owner == owner {
+				err = removeKey(ns, key)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// keyOwner returns the owner of the key after a write by author, which is the
+// key's current owner if it exists and has one.
+func keyOwner(ns buckets, key, prev []byte, author string) (string, error) {
+	if prev == nil {
+		return author, nil
+	}
+	m, err := getMeta(ns, key)
+	if err != nil || m == nil || m.Owner == "" {
+		return author, err
+	}
+	return m.Owner, nil
+}
+
+// account moves the key's usage from its stored value and owner to the new
+// value and owner, and returns an error if that would exceed the new owner's
+// quota.
+func account(ns buckets, key []byte, owner string, val []byte) error {
+	m, err := getMeta(ns, key)
+	if err != nil {
+		return err
+	}
+	if m != nil && m.Owner == owner {
+		stored := ns.Bucket(valueBucket).Get(key)
+		return addUsage(ns, owner, 0, int64(len(val)-len(stored)), true)
+	}
+	err = release(ns, key)
+	if err != nil {
+		return err
+	}
+	return addUsage(ns, owner, 1, int64(len(val)), true)
+}
+
+// release removes the key's stored value from its owner's usage.
+func release(ns buckets, key []byte) error {
+	m, err := getMeta(ns, key)
+	if err != nil || m == nil {
+		return err
+	}
+	stored := ns.Bucket(valueBucket).Get(key)
+	return addUsage(ns, m.Owner, -1, -int64(len(stored)), false)
+}
+
+// QuotaInfo returns the quota and usage of a user. Only admins and the user
+// itself can see it.
+func (db DB) QuotaInfo(caller *Identity, user string) (info *QuotaInfo, err error) {
+	if !caller.IsAdmin() && caller.Name != user {
+		return nil, ErrForbiddenRoot
+	}
+	err = db.View(func(tx *bolt.Tx) error {
+		u, err := getUser(tx, user)
+		if err != nil {
+			return err
+		}
+		info = &QuotaInfo{User: user}
+		if u.Quota != nil {
+			info.Quota = *u.Quota
+		}
+		info.Usage, info.Namespaces, err = totalUsage(tx, user)
+		return err
+	})
+	return
+}
+
+// SetQuota sets the quota of a user, where a zero quota removes all limits.
+// Existing keys are kept even if the user is above the new quota. Only admins
+// can do this.
+func (db DB) SetQuota(caller *Identity, user string, q Quota) error {
+	if !caller.IsAdmin() {
+		return ErrForbiddenRoot
+	}
+	if q.MaxKeys < 0 || q.MaxBytes < 0 {
+		return ErrBadQuota
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		return updateUser(tx, user, func(u *User) error {
+			u.Quota = &q
+			if q == (Quota{}) {
+				u.Quota = nil
+			}
+			return nil
+		})
+	})
+}
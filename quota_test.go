@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// usage returns the total usage of the user.
+func usage(t *testing.T, db DB, user string) Usage {
+	info, err := db.QuotaInfo(&Identity{Name: "root"}, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Usage
+}
+
+func TestExpiredKeysReleaseQuota(t *testing.T) {
+	db := newTestDB(t)
+	addTestUser(t, db, "bob")
+	err := db.SetQuota(&Identity{Name: "root"}, "bob", Quota{MaxKeys: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Put(DefaultNamespace, "a", []byte("a"), WriteOptions{Author: "bob", TTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Put(DefaultNamespace, "b", []byte("b"), WriteOptions{Author: "bob"})
+	if err != ErrKeyQuotaExceeded {
+		t.Fatalf("Expected the key quota to be exceeded, got %v", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		return expireAt(tx, []byte("a"), time.Now().Add(-time.Second))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Put(DefaultNamespace, "b", []byte("b"), WriteOptions{Author: "bob"})
+	if err != nil {
+		t.Fatalf("Expected the expired key to release its quota, got %s", err)
+	}
+	if u := usage(t, db, "bob"); u != (Usage{Keys: 1, Bytes: 1}) {
+		t.Errorf("Expected only the new key to count, got %+v", u)
+	}
+}
+
+func TestDropNamespaceReleasesQuota(t *testing.T) {
+	db := newTestDB(t)
+	addTestUser(t, db, "bob")
+	root := &Identity{Name: "root"}
+	err := db.SetQuota(root, "bob", Quota{MaxKeys: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Put("staging", "a", []byte("a"), WriteOptions{Author: "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u := usage(t, db, "bob"); u != (Usage{Keys: 1, Bytes: 1}) {
+		t.Fatalf("Expected the key to count, got %+v", u)
+	}
+	err = db.DropNamespace(root, "staging")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u := usage(t, db, "bob"); u != (Usage{}) {
+		t.Errorf("Expected no usage after dropping the namespace, got %+v", u)
+	}
+	_, err = db.Put(DefaultNamespace, "a", []byte("a"), WriteOptions{Author: "bob"})
+	if err != nil {
+		t.Errorf("Expected the dropped key to release its quota, got %s", err)
+	}
+}
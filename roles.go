@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/boltdb/bolt"
+)
+
+// The roles a user can have, either directly or through a group. Admins can do
+// everything except modifying root, which is a superuser with every role.
+const (
+	RoleAdmin  = "admin"
+	RoleBackup = "backup-operator"
+	RoleReader = "reader"
+	RoleWriter = "writer"
+)
+
+var groupBucket = []byte(`groups`)
+
+// defaultRoles are the roles of a user that has never had its roles or groups
+// set, which includes all users created before roles existed.
+var defaultRoles = []string{RoleWriter}
+
+var (
+	ErrForbiddenRole    = errors.New("Forbidden: You do not have the role required to do this")
+	ErrBadRole          = errors.New("Roles must be admin, backup-operator, reader or writer")
+	ErrCannotModifyRoot = errors.New("Cannot change the roles or groups of the root user")
+	ErrGroupNotExists   = errors.New("Group does not exist")
+)
+
+func validRole(role string) bool {
+	switch role {
+	case RoleAdmin, RoleBackup, RoleReader, RoleWriter:
+		return true
+	}
+	return false
+}
+
+// Group is a named set of roles given to all its members.
+type Group struct {
+	Roles []string
+}
+
+// Identity is the authenticated user doing a request, along with everything
+// needed to decide what the user may do.
+type Identity struct {
+	Name  string
+	Roles []string
+	// ACL is the access rules of the user, if Restricted is true.
+	ACL        ACL
+	Restricted bool
+	// Token is the token used to authenticate, or nil if basic auth was used.
+	Token *Token
+}
+
+// HasRole returns true if the identity has the role. Root has all roles, and
+// admins have all roles but root's. Tokens only keep the reader and writer
+// roles, so they can never be used to administer valheap.
+func (id *Identity) HasRole(role string) bool {
+	if id.Token != nil && role != RoleReader && role != RoleWriter {
+		return false
+	}
+	if id.Name == "root" {
+		return true
+	}
+	for _, r := range id.Roles {
+		if r == role || r == RoleAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAdmin returns true if the identity is root or has the admin role.
+func (id *Identity) IsAdmin() bool {
+	return id.HasRole(RoleAdmin)
+}
+
+// IsRoot returns true if the identity is root, and not using a token.
+func (id *Identity) IsRoot() bool {
+	return id.Name == "root" && id.HasRole(RoleAdmin)
+}
+
+// CanAccess returns true if the identity may read or write (depending on
+// access) the key in the namespace.
+func (id *Identity) CanAccess(ns, key, access string) bool {
+	if !id.HasRole(RoleWriter) && (access == AccessWrite || !id.HasRole(RoleReader)) {
+		return false
+	}
+	if id.Token != nil && !id.Token.Allows(key, access) {
+		return false
+	}
+	return !id.Restricted || id.ACL.Allows(ns, key, access)
+}
+
+func getGroup(tx *bolt.Tx, name string) (*Group, error) {
+	bs := tx.Bucket(groupBucket).Get([]byte(name))
+	if bs == nil {
+		return nil, ErrGroupNotExists
+	}
+	var g Group
+	if json.Unmarshal(bs, &g) != nil {
+		return nil, ErrDBCorrupted
+	}
+	return &g, nil
+}
+
+// loadIdentity returns the identity of the user, with its roles from both the
+// user itself and its groups.
+func loadIdentity(tx *bolt.Tx, name string, u *User) (*Identity, error) {
+	id := &Identity{Name: name, Roles: u.Roles}
+	if u.Roles == nil && u.Groups == nil {
+		id.Roles = defaultRoles
+	}
+	for _, groupName := range u.Groups {
+		g, err := getGroup(tx, groupName)
+		if err == ErrGroupNotExists {
+			continue // dropped after the user was added to it
+		}
+		if err != nil {
+			return nil, err
+		}
+		id.Roles = append(id.Roles[:len(id.Roles):len(id.Roles)], g.Roles...)
+	}
+	var err error
+	id.ACL, id.Restricted, err = getACL(tx, name)
+	if name == "root" {
+		id.Restricted = false
+	}
+	return id, err
+}
+
+// updateUser calls fn with the stored user and stores the result.
+func updateUser(tx *bolt.Tx, name string, fn func(u *User) error) error {
+	users := tx.Bucket(userBucket)
+	udata := users.Get([]byte(name))
+	if udata == nil {
+		return ErrUserNotExists
+	}
+	u, err := UnmarshalRawUser(udata)
+	if err != nil {
+		return ErrDBCorrupted
+	}
+	err = fn(u)
+	if err != nil {
+		return err
+	}
+	return users.Put([]byte(name), u.Marshal())
+}
+
+// UserIdentity returns the identity of a user, including its effective roles.
+// Only admins and the user itself can see it.
+func (db DB) UserIdentity(caller *Identity, user string) (id *Identity, err error) {
+	if !caller.IsAdmin() && caller.Name != user {
+		return nil, ErrForbiddenRoot
+	}
+	err = db.View(func(tx *bolt.Tx) error {
+		udata := tx.Bucket(userBucket).Get([]byte(user))
+		if udata == nil {
+			return ErrUserNotExists
+		}
+		u, err := UnmarshalRawUser(udata)
+		if err != nil {
+			return ErrDBCorrupted
+		}
+		id, err = loadIdentity(tx, user, u)
+		return err
+	})
+	return
+}
+
+// SetRoles replaces the roles of a user. Only admins can do this.
+func (db DB) SetRoles(caller *Identity, user string, roles []string) error {
+	if !caller.IsAdmin() {
+		return ErrForbiddenRoot
+	}
+	if user == "root" {
+		return ErrCannotModifyRoot
+	}
+	for _, role := range roles {
+		if !validRole(role) {
+			return ErrBadRole
+		}
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		return updateUser(tx, user, func(u *User) error {
+			u.Roles = append([]string{}, roles...)
+			return nil
+		})
+	})
+}
+
+// PutGroup creates or replaces a group with the given roles. Only admins can do
+// this.
+func (db DB) PutGroup(caller *Identity, name string, roles []string) error {
+	if !caller.IsAdmin() {
+		return ErrForbiddenRoot
+	}
+	for _, role := range roles {
+		if !validRole(role) {
+			return ErrBadRole
+		}
+	}
+	bs, err := json.Marshal(Group{Roles: roles})
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(groupBucket).Put([]byte(name), bs)
+	})
+}
+
+// RmGroup deletes a group. Its members lose the roles it gave them. Only admins
+// can do this.
+func (db DB) RmGroup(caller *Identity, name string) error {
+	if !caller.IsAdmin() {
+		return ErrForbiddenRoot
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(groupBucket).Get([]byte(name)) == nil {
+			return ErrGroupNotExists
+		}
+		return tx.Bucket(groupBucket).Delete([]byte(name))
+	})
+}
+
+// ListGroups returns all groups by name. Only admins can do this.
+func (db DB) ListGroups(caller *Identity) (groups map[string]Group, err error) {
+	if !caller.IsAdmin() {
+		return nil, ErrForbiddenRoot
+	}
+	groups = map[string]Group{}
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(groupBucket).ForEach(func(k, v []byte) error {
+			var g Group
+			if json.Unmarshal(v, &g) != nil {
+				return ErrDBCorrupted
+			}
+			groups[string(k)] = g
+			return nil
+		})
+	})
+	return
+}
+
+// SetMembership adds the user to or removes the user from the group. Only admins
+// can do this.
+func (db DB) SetMembership(caller *Identity, user, group string, member bool) error {
+	if !caller.IsAdmin() {
+		return ErrForbiddenRoot
+	}
+	if user == "root" {
+		return ErrCannotModifyRoot
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		if _, err := getGroup(tx, group); err != nil && member {
+			return err
+		}
+		return updateUser(tx, user, func(u *User) error {
+			groups := []string{}
+			for _, g := range u.Groups {
+				if g != group {
+					groups = append(groups, g)
+				}
+			}
+			if member {
+				groups = append(groups, group)
+			}
+			if u.Roles == nil && u.Groups == nil {
+				// Keep the default roles now that the user is in a group.
+				u.Roles = defaultRoles
+			}
+			u.Groups = groups
+			return nil
+		})
+	})
+}
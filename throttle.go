@@ -0,0 +1,197 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// freeLoginAttempts is the number of failed logins as a user allowed before
+	// clients have to back off, and freeIPLoginAttempts the number allowed from
+	// a single IP, which may be shared by many users.
+	freeLoginAttempts   = 3
+	freeIPLoginAttempts = 20
+	// maxLoginDelay is the longest a client has to back off, lockouts aside.
+	maxLoginDelay = 5 * time.Minute
+	// forgetFailuresAfter is how long failed logins are remembered.
+	forgetFailuresAfter = time.Hour
+)
+
+// LoginTracker tracks failed logins by username, and by client IP if ThrottleIPs
+// is true, and tells clients to back off exponentially after too many of them.
+// If LockoutAfter is positive, a user is locked out for LockoutDuration after
+// that many failures in a row. A nil LoginTracker tracks nothing.
+//
+// IP throttling is off by default, as all clients share the same IP behind a
+// reverse proxy, where it would let anyone keep every user out.
+type LoginTracker struct {
+	BaseDelay       time.Duration
+	LockoutAfter    int
+	LockoutDuration time.Duration
+	ThrottleIPs     bool
+
+	mu         sync.Mutex
+	failures   map[string]*loginFailures
+	lastForget time.Time
+}
+
+type loginFailures struct {
+	count int
+	last  time.Time
+	until time.Time
+}
+
+func NewLoginTracker(baseDelay time.Duration, lockoutAfter int, lockoutDuration time.Duration, throttleIPs bool) *LoginTracker {
+	return &LoginTracker{
+		BaseDelay:       baseDelay,
+		LockoutAfter:    lockoutAfter,
+		LockoutDuration: lockoutDuration,
+		ThrottleIPs:     throttleIPs,
+		failures:        map[string]*loginFailures{},
+	}
+}
+
+// clientIP returns the IP address the request came from.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func userKey(user string) string { return "user:" + user }
+func ipKey(ip string) string     { return "ip:" + ip }
+
+// Blocked returns how long the client must wait before trying to log in as the
+// user, or zero if it may try now. The user is empty for token logins.
+func (lt *LoginTracker) Blocked(user, ip string) time.Duration {
+	if lt == nil {
+		return 0
+	}
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	now := time.Now()
+	var wait time.Duration
+	keys := []string{userKey(user)}
+	if lt.ThrottleIPs {
+		keys = append(keys, ipKey(ip))
+	}
+	for _, key := range keys {
+		f := lt.failures[key]
+		if f != nil && f.until.Sub(now) > wait {
+			wait = f.until.Sub(now)
+		}
+	}
+	return wait
+}
+
+// Failed records a failed login as the user from the IP.
+func (lt *LoginTracker) Failed(user, ip string) {
+	if lt == nil {
+		return
+	}
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	now := time.Now()
+	lt.forget(now)
+	free := map[string]int{}
+	if lt.ThrottleIPs {
+		free[ipKey(ip)] = freeIPLoginAttempts
+	}
+	if user != "" {
+		free[userKey(user)] = freeLoginAttempts
+	}
+	for key, allowed := range free {
+		f := lt.failures[key]
+		if f == nil {
+			f = &loginFailures{}
+			lt.failures[key] = f
+		}
+		f.count++
+		f.last = now
+		if lt.BaseDelay > 0 && f.count >= allowed {
+			delay := lt.BaseDelay << uint(f.count-allowed)
+			if delay > maxLoginDelay || delay <= 0 {
+				delay = maxLoginDelay
+			}
+			f.until = now.Add(delay)
+		}
+	}
+	log.Warnf("Failed login as %q from %s", user, ip)
+	if user == "" || lt.LockoutAfter <= 0 {
+		return
+	}
+	if f := lt.failures[userKey(user)]; f.count >= lt.LockoutAfter {
+		f.until = now.Add(lt.LockoutDuration)
+		log.Warnf("User %s locked out for %s after %d failed logins", user, lt.LockoutDuration, f.count)
+	}
+}
+
+// Succeeded records a successful login as the user from the IP, which resets
+// the failures of both. The user is empty for token logins, which only reset
+// the IP's failures.
+func (lt *LoginTracker) Succeeded(user, ip string) {
+	if lt == nil {
+		return
+	}
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	if user != "" {
+		delete(lt.failures, userKey(user))
+	}
+	delete(lt.failures, ipKey(ip))
+}
+
+// Unlock forgets all failed logins as the user, and returns true if there were
+// any.
+func (lt *LoginTracker) Unlock(user string) bool {
+	if lt == nil {
+		return false
+	}
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	_, ok := lt.failures[userKey(user)]
+	delete(lt.failures, userKey(user))
+	return ok
+}
+
+// forget drops failures that are old enough to not matter anymore, at most once
+// a minute. The caller must hold the lock.
+func (lt *LoginTracker) forget(now time.Time) {
+	if now.Sub(lt.lastForget) < time.Minute {
+		return
+	}
+	lt.lastForget = now
+	for key, f := range lt.failures {
+		if now.Sub(f.last) > forgetFailuresAfter && now.After(f.until) {
+			delete(lt.failures, key)
+		}
+	}
+}
+
+// Unlock clears the failed logins of a user, which lifts any lockout. Only
+// admins can do this.
+func (db DB) Unlock(caller *Identity, user string) error {
+	if !caller.IsAdmin() {
+		return ErrForbiddenRoot
+	}
+	err := db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(userBucket).Get([]byte(user)) == nil {
+			return ErrUserNotExists
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if db.Logins.Unlock(user) {
+		log.Infof("User %s unlocked by %s", user, caller.Name)
+	}
+	return nil
+}
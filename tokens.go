@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var tokenBucket = []byte(`tokens`)
+
+// tokenPrefix starts every token, to tell them apart from other bearer tokens.
+const tokenPrefix = "vh_"
+
+var (
+	ErrTokenNotExists    = errors.New("Token does not exist")
+	ErrBadToken          = errors.New("Invalid or expired token")
+	ErrForbiddenForToken = errors.New("Forbidden: Tokens cannot be used to do this")
+)
+
+// Token is an API token a user has minted for themselves. Only the hash of the
+// secret is stored. A token can be restricted to read-only access and to keys
+// starting with Prefix. Tokens only have the reader and writer roles of their
+// user, and can never be used to manage users or tokens.
+type Token struct {
+	ID          string
+	User        string
+	Hash        string `json:",omitempty"`
+	Description string
+	Created     time.Time
+	Expires     time.Time
+	ReadOnly    bool
+	Prefix      string
+}
+
+// Allows returns true if the token's scope allows the access to the key.
+func (t *Token) Allows(key, access string) bool {
+	return (!t.ReadOnly || access == AccessRead) && strings.HasPrefix(key, t.Prefix)
+}
+
+func randomBytes(n int) []byte {
+	bs := make([]byte, n)
+	_, err := rand.Read(bs)
+	if err != nil {
+		panic(err)
+	}
+	return bs
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateToken mints a new token for the caller, and returns it along with the
+// secret to use in the Authorization header. The secret cannot be retrieved
+// later.
+func (db DB) CreateToken(caller *Identity, t Token) (secret string, tok *Token, err error) {
+	if caller.Token != nil {
+		return "", nil, ErrForbiddenForToken
+	}
+	t.ID = hex.EncodeToString(randomBytes(8))
+	secret = tokenPrefix + t.ID + "_" + base64.RawURLEncoding.EncodeToString(randomBytes(24))
+	t.User = caller.Name
+	t.Hash = hashSecret(secret)
+	t.Created = time.Now().UTC()
+	bs, err := json.Marshal(t)
+	if err != nil {
+		return "", nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(tokenBucket).Put([]byte(t.ID), bs)
+	})
+	t.Hash = ""
+	return secret, &t, err
+}
+
+// ListTokens returns the tokens of the caller.
+func (db DB) ListTokens(caller *Identity) (toks []Token, err error) {
+	if caller.Token != nil {
+		return nil, ErrForbiddenForToken
+	}
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(tokenBucket).ForEach(func(k, v []byte) error {
+			var t Token
+			if json.Unmarshal(v, &t) != nil {
+				return ErrDBCorrupted
+			}
+			if t.User == caller.Name {
+				t.Hash = ""
+				toks = append(toks, t)
+			}
+			return nil
+		})
+	})
+	return
+}
+
+// RevokeToken deletes a token. Only its owner and admins can do this.
+func (db DB) RevokeToken(caller *Identity, id string) error {
+	if caller.Token != nil {
+		return ErrForbiddenForToken
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		t, err := getToken(tx, id)
+		if err != nil {
+			return err
+		}
+		if t.User != caller.Name && !caller.IsAdmin() {
+			return ErrForbiddenRoot
+		}
+		return tx.Bucket(tokenBucket).Delete([]byte(id))
+	})
+}
+
+func getToken(tx *bolt.Tx, id string) (*Token, error) {
+	bs := tx.Bucket(tokenBucket).Get([]byte(id))
+	if bs == nil {
+		return nil, ErrTokenNotExists
+	}
+	var t Token
+	if json.Unmarshal(bs, &t) != nil {
+		return nil, ErrDBCorrupted
+	}
+	return &t, nil
+}
+
+// rmUserTokens deletes all tokens of the user.
+func rmUserTokens(tx *bolt.Tx, name string) error {
+	var ids [][]byte
+	err := tx.Bucket(tokenBucket).ForEach(func(k, v []byte) error {
+		var t Token
+		if json.Unmarshal(v, &t) == nil && t.User == name {
+			ids = append(ids, copyBytes(k))
+		}
+		return nil
+	})
+	for _, id := range ids {
+		if err == nil {
+			err = tx.Bucket(tokenBucket).Delete(id)
+		}
+	}
+	return err
+}
+
+// AuthorizeToken checks a token secret, and returns the token and its user if
+// it is valid and not expired.
+func AuthorizeToken(tx *bolt.Tx, secret string) (*Token, *User, error) {
+	if !strings.HasPrefix(secret, tokenPrefix) {
+		return nil, nil, ErrBadToken
+	}
+	parts := strings.SplitN(strings.TrimPrefix(secret, tokenPrefix), "_", 2)
+	if len(parts) != 2 {
+		return nil, nil, ErrBadToken
+	}
+	t, err := getToken(tx, parts[0])
+	if err == ErrTokenNotExists {
+		return nil, nil, ErrBadToken
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(t.Hash)) != 1 {
+		return nil, nil, ErrBadToken
+	}
+	if !t.Expires.IsZero() && time.Now().After(t.Expires) {
+		return nil, nil, ErrBadToken
+	}
+	udata := tx.Bucket(userBucket).Get([]byte(t.User))
+	if udata == nil {
+		return nil, nil, ErrBadToken
+	}
+	u, err := UnmarshalRawUser(udata)
+	if err != nil {
+		return nil, nil, ErrDBCorrupted
+	}
+	return t, u, nil
+}
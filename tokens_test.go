@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestTokensHaveNoAdminRoles(t *testing.T) {
+	db := newTestDB(t)
+	db.Audit = &AuditLog{}
+	addTestUser(t, db, "bob")
+	secret, _, err := db.CreateToken(&Identity{Name: "root"}, Token{Description: "ci"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := []string{
+		"/backup", "/audit", "/audit/verify", "/listusers", "/users/export",
+		"/groups", "/namespaces", "/user/bob", "/user/bob/acl", "/user/bob/quota",
+	}
+	for _, path := range paths {
+		if w := serve(db, "GET", path, nil, basicAuth("root")); w.Code != http.StatusOK {
+			t.Errorf("GET %s as root: expected 200, got %d: %s", path, w.Code, w.Body)
+		}
+		if w := serve(db, "GET", path, nil, bearerAuth(secret)); w.Code != http.StatusForbidden {
+			t.Errorf("GET %s with an unscoped root token: expected 403, got %d: %s", path, w.Code, w.Body)
+		}
+	}
+	if w := serve(db, "PUT", "/val/key", strings.NewReader("value"), bearerAuth(secret)); w.Code >= 300 {
+		t.Errorf("PUT /val/key with a root token: expected success, got %d: %s", w.Code, w.Body)
+	}
+	if w := serve(db, "GET", "/user/root", nil, bearerAuth(secret)); w.Code != http.StatusOK {
+		t.Errorf("GET /user/root with a root token: expected 200, got %d: %s", w.Code, w.Body)
+	}
+}
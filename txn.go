@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// TxnOp is a single operation in a transaction. Op is either "put", "delete"
+// or "check". Every operation may have preconditions on the key's current
+// value: IfMatch is an ETag the value must match, Equals is the exact value it
+// must have, and Absent requires that the key does not exist.
+type TxnOp struct {
+	Op      string
+	Key     string
+	Value   string  `json:",omitempty"`
+	TTL     string  `json:",omitempty"`
+	IfMatch string  `json:",omitempty"`
+	Equals  *string `json:",omitempty"`
+	Absent  bool    `json:",omitempty"`
+
+	ttl time.Duration
+}
+
+// TxnError is returned when a precondition of a transaction fails. Index is the
+// index of the failing operation.
+type TxnError struct {
+	Index int
+	Op    TxnOp
+}
+
+func (e *TxnError) Error() string {
+	return fmt.Sprintf("Precondition failed on operation %d (%s %s)", e.Index, e.Op.Op, e.Op.Key)
+}
+
+// validate checks that the operation is well-formed, and parses its TTL.
+func (op *TxnOp) validate() (err error) {
+	switch op.Op {
+	case "put", "delete", "check":
+	default:
+		return fmt.Errorf("unknown operation %q", op.Op)
+	}
+	if op.Key == "" {
+		return fmt.Errorf("missing key")
+	}
+	if op.TTL != "" && op.Op != "put" {
+		return fmt.Errorf("TTL can only be set on put")
+	}
+	op.ttl, err = parseTTL(op.TTL)
+	return
+}
+
+func (op TxnOp) check(ns buckets) error {
+	cur := liveValue(ns, []byte(op.Key))
+	if op.Equals != nil && (cur == nil || string(cur) != *op.Equals) {
+		return ErrPreconditionFailed
+	}
+	if op.Absent && cur != nil {
+		return ErrPreconditionFailed
+	}
+	return WriteOptions{IfMatch: op.IfMatch}.check(cur)
+}
+
+// ParseTxn parses a JSON list of transaction operations and validates them.
+func ParseTxn(data []byte) (ops []TxnOp, err error) {
+	err = json.Unmarshal(data, &ops)
+	if err != nil {
+		return nil, err
+	}
+	for i := range ops {
+		err = ops[i].validate()
+		if err != nil {
+			return nil, fmt.Errorf("operation %d: %s", i, err)
+		}
+	}
+	return ops, nil
+}
+
+// Txn performs the operations from ParseTxn in order inside a single
+// transaction. Each operation's preconditions are checked against the state
+// left by the operations before it. If any precondition fails, nothing is
+// changed and a *TxnError is returned.
+func (db DB) Txn(namespaceName string, ops []TxnOp, author string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		ns, err := ensureNamespace(tx, namespaceName)
+		if err != nil {
+			return err
+		}
+		for i, op := range ops {
+			if op.check(ns) != nil {
+				return &TxnError{Index: i, Op: op}
+			}
+			opts := WriteOptions{TTL: op.ttl, Author: author}
+			switch op.Op {
+			case "put":
+				err = db.putValue(ns, []byte(op.Key), []byte(op.Value), opts)
+			case "delete":
+				err = db.deleteValue(ns, []byte(op.Key), opts)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
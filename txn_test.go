@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+// contentType returns the content type stored for the key in the default
+// namespace.
+func contentType(t *testing.T, db DB, key string) string {
+	km, err := db.GetMeta(DefaultNamespace, key)
+	if err != nil || km == nil || km.Meta == nil {
+		t.Fatalf("Unable to get the metadata of %s: %v %v", key, km, err)
+	}
+	return km.Meta.ContentType
+}
+
+func TestTxnKeepsContentType(t *testing.T) {
+	db := newTestDB(t)
+	_, err := db.Put(DefaultNamespace, "key", []byte("{}"), WriteOptions{Author: "root", ContentType: "application/json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops, err := ParseTxn([]byte(`[{"Op": "put", "Key": "key", "Value": "[]"}, {"Op": "put", "Key": "new", "Value": "x"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Txn(DefaultNamespace, ops, "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := contentType(t, db, "key"); ct != "application/json" {
+		t.Errorf("Expected the content type to be kept, got %q", ct)
+	}
+	if ct := contentType(t, db, "new"); ct != "" {
+		t.Errorf("Expected no content type on a new key, got %q", ct)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// The results of importing a line of an htpasswd file.
+const (
+	ImportAdded    = "added"
+	ImportUpdated  = "updated"
+	ImportSkipped  = "skipped"
+	ImportRejected = "rejected"
+)
+
+// ImportResult is the result of importing a line of an htpasswd file. Reason
+// explains why the line was skipped or rejected.
+type ImportResult struct {
+	Line   int
+	User   string
+	Result string
+	Reason string
+}
+
+// ExportedUser is a user as written by ExportUsers.
+type ExportedUser struct {
+	Name string
+	*User
+}
+
+// parseHtpasswdLine parses a line on the form user:hash, and returns the user
+// with the hash if it is a bcrypt hash.
+func parseHtpasswdLine(line string) (name string, u *User, reason string) {
+	i := strings.Index(line, ":")
+	if i < 0 {
+		return "", nil, "not on the form user:hash"
+	}
+	name, hash := line[:i], line[i+1:]
+	switch {
+	case name == "":
+		return name, nil, "empty username"
+	case strings.Contains(name, "/"):
+		return name, nil, "usernames cannot contain /"
+	case !strings.HasPrefix(hash, "$2"):
+		return name, nil, "only bcrypt hashes are supported"
+	}
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		return name, nil, fmt.Sprintf("malformed bcrypt hash: %s", err)
+	}
+	return name, &User{HashPass: hash, HashAlgo: HashBcrypt, HashCost: cost}, ""
+}
+
+// ImportUsers adds the users in an Apache htpasswd file, using their bcrypt
+// hashes as is. Existing users are skipped unless overwrite is true, in which
+// case only their passwords are replaced. Lines with other hash formats are
+// rejected, and the result of every user line is returned. Root is never
+// changed, and only root can do this.
+func (db DB) ImportUsers(caller *Identity, r io.Reader, overwrite bool) (results []ImportResult, err error) {
+	if !caller.IsRoot() {
+		return nil, ErrForbiddenRoot
+	}
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	err = db.Update(func(tx *bolt.Tx) error {
+		results = nil
+		for i, line := range lines {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			name, u, reason := parseHtpasswdLine(line)
+			res := ImportResult{Line: i + 1, User: name, Result: ImportRejected, Reason: reason}
+			if u != nil {
+				res.Result, res.Reason = ImportAdded, ""
+				err := updateUser(tx, name, func(old *User) error {
+					switch {
+					case name == "root":
+						res.Result, res.Reason = ImportSkipped, "root cannot be imported"
+					case !overwrite:
+						res.Result, res.Reason = ImportSkipped, "user already exists"
+					default:
+						res.Result = ImportUpdated
+						old.HashPass, old.HashAlgo, old.HashCost = u.HashPass, u.HashAlgo, u.HashCost
+					}
+					return nil
+				})
+				if err == ErrUserNotExists {
+					u.Created = now
+					err = tx.Bucket(userBucket).Put([]byte(name), u.Marshal())
+				}
+				if err != nil {
+					return err
+				}
+			}
+			results = append(results, res)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, res := range results {
+		if res.Result == ImportUpdated {
+			db.AuthCache.Forget(res.User)
+		}
+	}
+	return results, nil
+}
+
+// ExportUsers writes every user along with its password hash to w as JSON
+// lines. Only root can do this.
+func (db DB) ExportUsers(caller *Identity, w io.Writer) error {
+	if !caller.IsRoot() {
+		return ErrForbiddenRoot
+	}
+	enc := json.NewEncoder(w)
+	return db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(userBucket).ForEach(func(k, v []byte) error {
+			u, err := UnmarshalRawUser(v)
+			if err != nil {
+				return ErrDBCorrupted
+			}
+			return enc.Encode(ExportedUser{Name: string(k), User: u})
+		})
+	})
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/boltdb/bolt"
+	log "github.com/sirupsen/logrus"
+)
+
+// loginRecordInterval is how often successful and failed logins are recorded,
+// to avoid a write on every request.
+const loginRecordInterval = time.Minute
+
+var (
+	ErrUserDisabled      = errors.New("Forbidden: User is disabled")
+	ErrCannotDisableRoot = errors.New("Cannot disable the root user")
+)
+
+// UserInfo is the details of a user, as shown to admins and the user itself.
+type UserInfo struct {
+	Name               string
+	Description        string
+	Created            time.Time
+	LastLogin          time.Time
+	LastFailedLogin    time.Time
+	Disabled           bool
+	MustChangePassword bool
+	Roles              []string
+	Groups             []string
+}
+
+// UserDetails returns the details of a user, with its effective roles. Only
+// admins and the user itself can see them.
+func (db DB) UserDetails(caller *Identity, name string) (info *UserInfo, err error) {
+	if !caller.IsAdmin() && caller.Name != name {
+		return nil, ErrForbiddenRoot
+	}
+	err = db.View(func(tx *bolt.Tx) error {
+		u, err := getUser(tx, name)
+		if err != nil {
+			return err
+		}
+		id, err := loadIdentity(tx, name, u)
+		if err != nil {
+			return err
+		}
+		info = &UserInfo{
+			Name:               name,
+			Description:        u.Description,
+			Created:            u.Created,
+			LastLogin:          u.LastLogin,
+			LastFailedLogin:    u.LastFailedLogin,
+			Disabled:           u.Disabled,
+			MustChangePassword: u.MustChangePassword,
+			Roles:              id.Roles,
+			Groups:             u.Groups,
+		}
+		return nil
+	})
+	return
+}
+
+// SetDisabled disables or enables a user. Disabled users cannot log in. Only
+// admins can do this.
+func (db DB) SetDisabled(caller *Identity, name string, disabled bool) error {
+	if !caller.IsAdmin() {
+		return ErrForbiddenRoot
+	}
+	if name == "root" {
+		return ErrCannotDisableRoot
+	}
+	defer db.AuthCache.Forget(name)
+	return db.Update(func(tx *bolt.Tx) error {
+		return updateUser(tx, name, func(u *User) error {
+			u.Disabled = disabled
+			return nil
+		})
+	})
+}
+
+// recordLogin records a successful login as the user, unless one was recorded
+// recently.
+func (db DB) recordLogin(name string, u *User) {
+	if time.Since(u.LastLogin) < loginRecordInterval {
+		return
+	}
+	err := db.Update(func(tx *bolt.Tx) error {
+		return updateUser(tx, name, func(u *User) error {
+			u.LastLogin = time.Now().UTC()
+			return nil
+		})
+	})
+	if err != nil && err != ErrUserNotExists {
+		log.Errorf("Unable to record login of %s: %s", name, err)
+	}
+}
+
+// recordFailedLogin records a failed login as the user, if it exists and no
+// failed login was recorded recently. Checking first means that unauthenticated
+// clients cannot cause a write on every attempt.
+func (db DB) recordFailedLogin(name string) {
+	recent := true
+	db.View(func(tx *bolt.Tx) error {
+		u, err := getUser(tx, name)
+		recent = err != nil || time.Since(u.LastFailedLogin) < loginRecordInterval
+		return nil
+	})
+	if recent {
+		return
+	}
+	err := db.Update(func(tx *bolt.Tx) error {
+		return updateUser(tx, name, func(u *User) error {
+			u.LastFailedLogin = time.Now().UTC()
+			return nil
+		})
+	})
+	if err != nil && err != ErrUserNotExists {
+		log.Errorf("Unable to record failed login of %s: %s", name, err)
+	}
+}
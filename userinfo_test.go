@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestFailedLoginsRecordedOncePerInterval(t *testing.T) {
+	db := newTestDB(t)
+	addTestUser(t, db, "bob")
+	wrong := func(r *http.Request) { r.SetBasicAuth("bob", "wrong password") }
+	if w := serve(db, "GET", "/val/key", nil, wrong); w.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401, got %d: %s", w.Code, w.Body)
+	}
+	root := &Identity{Name: "root"}
+	info, err := db.UserDetails(root, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := info.LastFailedLogin
+	if first.IsZero() {
+		t.Fatal("Expected the failed login to be recorded")
+	}
+	before := db.Stats().TxStats.Write
+	for i := 0; i < 5; i++ {
+		serve(db, "GET", "/val/key", nil, wrong)
+		serve(db, "GET", "/val/key", nil, func(r *http.Request) { r.SetBasicAuth("nobody", "password") })
+	}
+	if writes := db.Stats().TxStats.Write - before; writes != 0 {
+		t.Errorf("Expected no writes for repeated failed logins, got %d", writes)
+	}
+	info, err = db.UserDetails(root, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.LastFailedLogin.Equal(first) {
+		t.Errorf("Expected the last failed login to stay %s, got %s", first, info.LastFailedLogin)
+	}
+}
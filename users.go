@@ -4,23 +4,52 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/boltdb/bolt"
 	"golang.org/x/crypto/bcrypt"
 )
 
-const bcryptCost = 6
-
 var ErrDBCorrupted = errors.New("Unexpected error (database corrupted?)")
-var ErrForbiddenRoot = errors.New("Forbidden: Must be root (or the user itself) to do this")
+var ErrForbiddenRoot = errors.New("Forbidden: Must be root or an admin (or the user itself) to do this")
 var ErrUserNotExists = errors.New("User does not exist")
 var ErrCannotDeleteRoot = errors.New("Cannot delete the root user")
+var ErrMustChangePassword = errors.New("Forbidden: You must change your password first")
+var ErrNoPassword = errors.New("User has no password")
 
 type User struct {
 	HashPass string
+	// HashAlgo and HashCost are the settings HashPass was hashed with. They are
+	// empty for passwords hashed with bcrypt before they were recorded.
+	HashAlgo string `json:",omitempty"`
+	HashCost int    `json:",omitempty"`
+	// Roles and Groups are nil for users that have never had them set, which
+	// gives them the default roles.
+	Roles  []string
+	Groups []string
+	// MustChangePassword is set for users that cannot do anything but change
+	// their own password.
+	MustChangePassword bool `json:",omitempty"`
+	// Created, LastLogin and LastFailedLogin are zero if unknown. Successful
+	// and failed logins are each recorded at most once a minute.
+	Created         time.Time
+	LastLogin       time.Time
+	LastFailedLogin time.Time
+	Disabled        bool   `json:",omitempty"`
+	Description     string `json:",omitempty"`
+	// Quota limits the keys the user can own, if not nil.
+	Quota *Quota `json:",omitempty"`
 }
 
+// Authorize checks the password against the user's password hash. Users without
+// one, like those provisioned from a JWT, cannot log in with a password.
 func (u *User) Authorize(pass string) error {
+	if u.HashPass == "" {
+		return ErrNoPassword
+	}
+	if u.HashAlgo == HashArgon2id {
+		return compareArgon2id(u.HashPass, pass)
+	}
 	return bcrypt.CompareHashAndPassword([]byte(u.HashPass), []byte(pass))
 }
 
@@ -37,59 +66,94 @@ func UnmarshalRawUser(data []byte) (u *User, err error) {
 	return
 }
 
-func UnmarshalUser(data []byte) (u *User, err error) {
+// UnmarshalUser reads the user with the given name and its password from JSON,
+// and hashes the password with the hasher. If the password does not satisfy
+// the policy, a PolicyError is returned.
+func UnmarshalUser(name string, data []byte, h Hasher, policy *PasswordPolicy) (u *User, err error) {
 	dataShape := struct {
-		Password string
+		Password    string
+		Description string
 	}{}
 	err = json.Unmarshal(data, &dataShape)
 	if err != nil {
 		return
 	}
-	bs, err := bcrypt.GenerateFromPassword([]byte(dataShape.Password), bcryptCost)
+	err = policy.Check(name, dataShape.Password)
 	if err != nil {
-		return
+		return nil, err
 	}
-	return &User{HashPass: string(bs)}, nil
-}
-
-var DefaultRoot = User{}
-
-func init() {
-	bs, _ := bcrypt.GenerateFromPassword([]byte(`toor`), bcryptCost)
-	DefaultRoot.HashPass = string(bs)
+	u = &User{Description: dataShape.Description}
+	err = h.SetPassword(u, dataShape.Password)
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
 }
 
-// Puts a user into the system, potentially replacing it with the existing user.
-// Only root and the user itself can modify this value
-func (db DB) PutUser(name, putUname string, u *User) error {
-	if name != "root" && name != putUname {
+// Puts a user into the system, potentially replacing the password of the
+// existing user. Only admins and the user itself can modify this value, and only
+// root can modify root.
+func (db DB) PutUser(caller *Identity, putUname string, u *User) error {
+	if caller.Token != nil {
+		return ErrForbiddenForToken
+	}
+	if !caller.IsAdmin() && caller.Name != putUname {
+		return ErrForbiddenRoot
+	}
+	if putUname == "root" && caller.Name != "root" {
 		return ErrForbiddenRoot
 	}
+	defer db.AuthCache.Forget(putUname)
 	return db.Update(func(tx *bolt.Tx) error {
-		users := tx.Bucket(userBucket)
-		return users.Put([]byte(putUname), u.Marshal())
+		err := updateUser(tx, putUname, func(old *User) error {
+			old.HashPass, old.HashAlgo, old.HashCost = u.HashPass, u.HashAlgo, u.HashCost
+			if caller.Name == putUname {
+				old.MustChangePassword = false
+			}
+			if u.Description != "" {
+				old.Description = u.Description
+			}
+			return nil
+		})
+		if err == ErrUserNotExists {
+			u.Created = time.Now().UTC()
+			err = tx.Bucket(userBucket).Put([]byte(putUname), u.Marshal())
+		}
+		return err
 	})
 }
 
-func (db DB) RmUser(name, toDelete string) error {
-	if name != "root" && name != toDelete {
+func (db DB) RmUser(caller *Identity, toDelete string) error {
+	if caller.Token != nil {
+		return ErrForbiddenForToken
+	}
+	if !caller.IsAdmin() && caller.Name != toDelete {
 		return ErrForbiddenRoot
 	}
 	if toDelete == "root" {
 		return ErrCannotDeleteRoot
 	}
+	defer db.AuthCache.Forget(toDelete)
 	return db.Update(func(tx *bolt.Tx) error {
 		users := tx.Bucket(userBucket)
 		uinfo := users.Get([]byte(toDelete))
 		if uinfo == nil {
 			return ErrUserNotExists
 		}
+		err := tx.Bucket(aclBucket).Delete([]byte(toDelete))
+		if err != nil {
+			return err
+		}
+		err = rmUserTokens(tx, toDelete)
+		if err != nil {
+			return err
+		}
 		return users.Delete([]byte(toDelete))
 	})
 }
 
-func (db DB) ListUsers(name string) (keys [][]byte, err error) {
-	if name != "root" {
+func (db DB) ListUsers(caller *Identity) (keys [][]byte, err error) {
+	if !caller.IsAdmin() {
 		return nil, ErrForbiddenRoot
 	}
 	err = db.View(func(tx *bolt.Tx) error {
@@ -102,15 +166,30 @@ func (db DB) ListUsers(name string) (keys [][]byte, err error) {
 	return
 }
 
-func AuthorizeUser(tx *bolt.Tx, name, pass string) error {
+// getUser returns the stored user with the given name.
+func getUser(tx *bolt.Tx, name string) (*User, error) {
+	udata := tx.Bucket(userBucket).Get([]byte(name))
+	if udata == nil {
+		return nil, ErrUserNotExists
+	}
+	u, err := UnmarshalRawUser(udata)
+	if err != nil {
+		return nil, ErrDBCorrupted
+	}
+	return u, nil
+}
+
+// AuthorizeUser checks the password of the user, and returns the user if it is
+// correct.
+func AuthorizeUser(tx *bolt.Tx, name, pass string) (*User, error) {
 	users := tx.Bucket(userBucket)
 	udata := users.Get([]byte(name))
 	if udata == nil {
-		return fmt.Errorf("No user with username %q", name)
+		return nil, fmt.Errorf("No user with username %q", name)
 	}
 	user, err := UnmarshalRawUser(udata)
 	if err != nil {
-		return ErrDBCorrupted
+		return nil, ErrDBCorrupted
 	}
-	return user.Authorize(pass)
+	return user, user.Authorize(pass)
 }
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/boltdb/bolt"
@@ -12,23 +15,54 @@ import (
 )
 
 func main() {
-	var dbpath, certFile, keyFile string
+	var dbpath, certFile, keyFile, hashAlgo, rootPass, rootPassFile string
+	var clientCA, clientCertMode, clientCertField, auditFile, auditKeyFile, denylistFile string
+	var jwtKeys, jwtIssuer, jwtAudience, jwtClaim, jwtRole string
+	var audit, throttleIPs bool
 	var help bool
-	var port int
+	var port, historyLimit, lockoutAfter, hashCost, minPassLength, passClasses int
+	var reapInterval, loginDelay, lockoutDuration, authCacheTTL time.Duration
 	flag.StringVar(&dbpath, "db", "valheap.db", "Path to the bolt DB file to use")
 	flag.IntVar(&port, "port", 8080, "The port to listen on HTTP requests")
 	flag.BoolVar(&help, "help", false, "Prints this help message")
 	flag.StringVar(&certFile, "cert", "", "The path to the TLS certificate to use")
 	flag.StringVar(&keyFile, "key", "", "The path to the TLS private key to use")
+	flag.IntVar(&historyLimit, "history", 10, "Number of previous revisions to keep per key (0 to disable, -1 to keep all)")
+	flag.DurationVar(&reapInterval, "reap-interval", time.Minute, "How often to purge expired keys from the database")
+	flag.DurationVar(&loginDelay, "login-delay", time.Second, "Initial back-off after repeated failed logins, doubling on each failure (0 to disable throttling)")
+	flag.IntVar(&lockoutAfter, "lockout-after", 0, "Lock a user out after this many failed logins in a row (0 to disable)")
+	flag.BoolVar(&throttleIPs, "throttle-ips", false, "Also throttle failed logins by client IP (do not use behind a reverse proxy, where all clients share an IP)")
+	flag.DurationVar(&lockoutDuration, "lockout-duration", 15*time.Minute, "How long a user is locked out")
+	flag.DurationVar(&authCacheTTL, "auth-cache", 10*time.Second, "How long successful password checks are cached (0 to disable)")
+	flag.StringVar(&hashAlgo, "hash", HashBcrypt, "The algorithm to hash passwords with (bcrypt or argon2id)")
+	flag.IntVar(&hashCost, "hash-cost", 0, "The cost to hash passwords with: the bcrypt cost, or the number of argon2id passes (0 for the default)")
+	flag.StringVar(&rootPass, "root-password", "", "The initial root password, used if root does not exist (also read from $VALHEAP_ROOT_PASSWORD)")
+	flag.StringVar(&rootPassFile, "root-password-file", "", "A file containing the initial root password")
+	flag.StringVar(&clientCA, "client-ca", "", "The path to the CA certificates to verify TLS client certificates with")
+	flag.StringVar(&clientCertMode, "client-cert-mode", ClientCertOptional, "Whether client certificates are optional, required (require), or required along with a password or token (both)")
+	flag.StringVar(&clientCertField, "client-cert-user", CertFieldCN, "The client certificate field naming the user: the subject's cn, or the first dns, email or uri SAN")
+	flag.BoolVar(&audit, "audit", true, "Record all requests that may change something in the audit log")
+	flag.StringVar(&auditFile, "audit-file", "", "A file to also append the audit log to as JSON lines")
+	flag.StringVar(&auditKeyFile, "audit-key", "", "A file with the secret key the audit log is chained with, created if missing (defaults to the -db path with .audit-key appended)")
+	flag.IntVar(&minPassLength, "password-min-length", 8, "The minimum length of new passwords")
+	flag.StringVar(&denylistFile, "password-denylist", "", "A file of common passwords to reject, one per line")
+	flag.IntVar(&passClasses, "password-classes", 0, "The number of character classes (lowercase, uppercase, digits, others) new passwords must contain")
+	flag.StringVar(&jwtKeys, "jwt-keys", "", "A JWKS or PEM file with the public keys to verify JWT bearer tokens with (reloaded on SIGHUP or when modified)")
+	flag.StringVar(&jwtIssuer, "jwt-issuer", "", "The issuer (iss) JWTs must have, if set")
+	flag.StringVar(&jwtAudience, "jwt-audience", "", "The audience (aud) JWTs must have, if set")
+	flag.StringVar(&jwtClaim, "jwt-user-claim", "sub", "The JWT claim naming the user")
+	flag.StringVar(&jwtRole, "jwt-provision-role", "", "Create users that log in with a JWT but don't exist, with this role")
 	flag.Parse()
 
 	if help {
 		fmt.Println(`Valheap is an HTTP key/value storage with basic auth
 
-Usage: ./valheap [options]
+Usage: ./valheap [options] [command]
 
 Where options may be:`)
 		flag.PrintDefaults()
+		fmt.Println()
+		fmt.Println(offlineUsage)
 		os.Exit(1)
 	}
 
@@ -37,22 +71,126 @@ Where options may be:`)
 		os.Exit(1)
 	}
 
+	if clientCA != "" && certFile == "" {
+		fmt.Fprintln(os.Stderr, "-client-ca requires TLS, specify -cert and -key")
+		os.Exit(1)
+	}
+	var clientCerts *ClientCertAuth
+	var tlsConfig *tls.Config
+	if clientCA != "" {
+		var err error
+		clientCerts, err = NewClientCertAuth(clientCertMode, clientCertField)
+		if err == nil {
+			tlsConfig, err = clientCerts.TLSConfig(clientCA)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	hasher, err := NewHasher(hashAlgo, hashCost)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	policy := &PasswordPolicy{MinLength: minPassLength, Classes: passClasses}
+	if denylistFile != "" {
+		policy.Denylist, err = LoadDenylist(denylistFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to read password denylist: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	var jwtAuth *JWTAuth
+	if jwtKeys != "" {
+		jwtAuth, err = NewJWTAuth(jwtKeys, jwtIssuer, jwtAudience, jwtClaim, jwtRole)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to set up JWT authentication: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if rootPass == "" && rootPassFile != "" {
+		bs, err := ioutil.ReadFile(rootPassFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to read root password: %s\n", err)
+			os.Exit(1)
+		}
+		rootPass = strings.TrimRight(string(bs), "\r\n")
+	}
+	if rootPass == "" {
+		rootPass = os.Getenv("VALHEAP_ROOT_PASSWORD")
+	}
+
 	log.Infof("Opening database file %s", dbpath)
 	db, err := bolt.Open(dbpath, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err == bolt.ErrTimeout {
+		log.Fatal("The database file is locked. Is the server already running?")
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer db.Close()
-	EnsureBuckets(db)
+	EnsureBuckets(db, rootPass, hasher)
+	vdb := DB{
+		DB:             db,
+		HistoryLimit:   historyLimit,
+		Hasher:         hasher,
+		ClientCerts:    clientCerts,
+		PasswordPolicy: policy,
+		JWT:            jwtAuth,
+	}
+	if audit {
+		if auditKeyFile == "" {
+			auditKeyFile = dbpath + ".audit-key"
+		}
+		vdb.Audit = &AuditLog{}
+		vdb.Audit.Key, err = LoadAuditKey(auditKeyFile)
+		if err != nil {
+			log.Fatalf("Unable to load the audit log key: %s", err)
+		}
+	}
+	if audit && auditFile != "" {
+		vdb.Audit.File, err = os.OpenFile(auditFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer vdb.Audit.File.Close()
+	}
+	if loginDelay > 0 || lockoutAfter > 0 {
+		vdb.Logins = NewLoginTracker(loginDelay, lockoutAfter, lockoutDuration, throttleIPs)
+	}
+	if authCacheTTL > 0 {
+		vdb.AuthCache = NewAuthCache(authCacheTTL)
+	}
+	if flag.NArg() > 0 {
+		err = vdb.RunCommand(flag.Args())
+		if err == ErrUnknownCommand {
+			fmt.Fprintln(os.Stderr, offlineUsage)
+		}
+		if err != nil {
+			db.Close()
+			log.Fatal(err)
+		}
+		return
+	}
+	go vdb.ReapExpired(reapInterval)
+	if jwtAuth != nil {
+		go jwtAuth.ReloadOnHangup()
+	}
 
 	addr := fmt.Sprintf(":%d", port)
 
 	log.Infof("Now listening on port %d", port)
 	if certFile != "" {
-		err = http.ListenAndServeTLS(addr, certFile, keyFile, DB{db}.ServeMux())
+		srv := &http.Server{Addr: addr, Handler: vdb.ServeMux(), TLSConfig: tlsConfig}
+		err = srv.ListenAndServeTLS(certFile, keyFile)
 	} else {
 		log.Warning("Not using TLS. If you want to be secure, either enable it or put this behind nginx or something similar")
-		err = http.ListenAndServe(addr, DB{db}.ServeMux())
+		err = http.ListenAndServe(addr, vdb.ServeMux())
 	}
 	log.Fatal(err)
 }
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testPassword is the password of root and every user added by addTestUser.
+const testPassword = "correct horse"
+
+// testHasher hashes passwords as cheaply as possible, to keep tests fast.
+var testHasher = Hasher{Algo: HashBcrypt, Cost: bcrypt.MinCost}
+
+// newTestDB returns a DB in a temporary directory, with root's password set to
+// testPassword.
+func newTestDB(t testing.TB) DB {
+	log.SetOutput(ioutil.Discard)
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "valheap.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	EnsureBuckets(db, testPassword, testHasher)
+	return DB{DB: db, Hasher: testHasher}
+}
+
+// addTestUser adds a user with the password testPassword and the given roles,
+// or the default roles if none are given.
+func addTestUser(t testing.TB, db DB, name string, roles ...string) {
+	root := &Identity{Name: "root"}
+	u := &User{}
+	err := db.Hasher.SetPassword(u, testPassword)
+	if err == nil {
+		err = db.PutUser(root, name, u)
+	}
+	if err == nil && len(roles) > 0 {
+		err = db.SetRoles(root, name, roles)
+	}
+	if err != nil {
+		t.Fatalf("Unable to add user %s: %s", name, err)
+	}
+}
+
+// serve sends a request to the DB's handlers, authenticated with auth, and
+// returns the response.
+func serve(db DB, method, path string, body io.Reader, auth func(r *http.Request)) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, body)
+	if auth != nil {
+		auth(r)
+	}
+	w := httptest.NewRecorder()
+	db.ServeMux().ServeHTTP(w, r)
+	return w
+}
+
+// basicAuth authenticates requests as the user with testPassword.
+func basicAuth(user string) func(r *http.Request) {
+	return func(r *http.Request) {
+		r.SetBasicAuth(user, testPassword)
+	}
+}
+
+// bearerAuth authenticates requests with the bearer token.
+func bearerAuth(token string) func(r *http.Request) {
+	return func(r *http.Request) {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+}
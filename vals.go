@@ -1,8 +1,12 @@
 package main
 
 import (
-	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
 	"errors"
+	"fmt"
+	"strings"
+	"time"
 
 	"github.com/boltdb/bolt"
 	log "github.com/sirupsen/logrus"
@@ -10,14 +14,95 @@ import (
 
 type DB struct {
 	*bolt.DB
+	// HistoryLimit is the number of previous revisions kept for each key. If
+	// zero, no history is kept, and if negative, all revisions are kept.
+	HistoryLimit int
+	// Logins tracks failed logins to throttle them, if not nil.
+	Logins *LoginTracker
+	// AuthCache caches successful password checks, if not nil.
+	AuthCache *AuthCache
+	// Hasher hashes new passwords, and passwords hashed with other settings are
+	// rehashed with it on login.
+	Hasher Hasher
+	// ClientCerts authenticates requests by their TLS client certificate, if
+	// not nil.
+	ClientCerts *ClientCertAuth
+	// Audit records all requests that may change something, if not nil.
+	Audit *AuditLog
+	// PasswordPolicy is the policy new passwords must satisfy.
+	PasswordPolicy *PasswordPolicy
+	// JWT authenticates bearer tokens that are not API tokens as JWTs, if not
+	// nil.
+	JWT *JWTAuth
 }
 
 var (
 	userBucket      = []byte(`users`)
 	valueBucket     = []byte(`values`)
 	ErrUnauthorized = errors.New("Unauthorized")
+
+	ErrPreconditionFailed = errors.New("Precondition failed")
 )
 
+// WriteOptions contains the conditions a write to a key must satisfy, along
+// with properties of the value to write. IfMatch and IfNoneMatch hold the raw
+// header values of If-Match and If-None-Match, and are ignored if empty. If TTL
+// is nonzero, the value expires after that duration, and if KeepTTL is true,
+// any existing expiry time is kept instead. Author is the user doing the write,
+// and ContentType the content type of the value, if known. If not, an existing
+// key keeps its content type.
+type WriteOptions struct {
+	IfMatch     string
+	IfNoneMatch string
+	TTL         time.Duration
+	KeepTTL     bool
+	Author      string
+	ContentType string
+}
+
+// Entry is a value stored in valheap, along with its properties.
+type Entry struct {
+	Value []byte
+	// Expires is the time the value expires, or the zero time if it doesn't.
+	Expires time.Time
+	// Meta is the metadata of the value, or nil if it has none.
+	Meta *Meta
+}
+
+// ETag returns the entity tag for a value, which is a quoted hash of its
+// content.
+func ETag(val []byte) string {
+	sum := sha256.Sum256(val)
+	return fmt.Sprintf(`"%x"`, sum[:16])
+}
+
+// etagMatches returns true if any of the comma separated entity tags in header
+// matches the value. A nil value is considered to not exist, and will never
+// match anything.
+func etagMatches(header string, val []byte) bool {
+	if val == nil {
+		return false
+	}
+	etag := ETag(val)
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func (opts WriteOptions) check(cur []byte) error {
+	if opts.IfMatch != "" && !etagMatches(opts.IfMatch, cur) {
+		return ErrPreconditionFailed
+	}
+	if opts.IfNoneMatch != "" && etagMatches(opts.IfNoneMatch, cur) {
+		return ErrPreconditionFailed
+	}
+	return nil
+}
+
 func copyBytes(bs []byte) []byte {
 	if bs == nil {
 		return nil
@@ -27,46 +112,171 @@ func copyBytes(bs []byte) []byte {
 	return ret
 }
 
-func (db DB) Get(key string) (val []byte, err error) {
+// Get returns the entry stored under key in the namespace, or nil if there is
+// no such key.
+func (db DB) Get(namespaceName, key string) (e *Entry, err error) {
 	err = db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(valueBucket)
-		val = copyBytes(bucket.Get([]byte(key)))
+		ns := namespace(tx, namespaceName)
+		if ns == nil {
+			return nil
+		}
+		val := liveValue(ns, []byte(key))
+		if val == nil {
+			return nil
+		}
+		meta, err := getMeta(ns, []byte(key))
+		if err != nil {
+			return err
+		}
+		e = &Entry{
+			Value:   copyBytes(val),
+			Expires: expiresAt(ns, []byte(key)),
+			Meta:    meta,
+		}
 		return nil
 	})
 	return
 }
 
-func (db DB) Put(key string, val []byte) (err error) {
-	err = db.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(valueBucket)
-		return bucket.Put([]byte(key), val)
-	})
-	return
+// putValue stores the value under key in the namespace if the write options are
+// satisfied.
+func (db DB) putValue(ns buckets, key, val []byte, opts WriteOptions) error {
+	prev := liveValue(ns, key)
+	err := opts.check(prev)
+	if err != nil {
+		return err
+	}
+	if prev == nil && ns.Bucket(valueBucket).Get(key) != nil {
+		// The key has expired but not been reaped yet, so reap it now to
+		// release its usage.
+		err = removeKey(ns, key)
+		if err != nil {
+			return err
+		}
+	}
+	owner, err := keyOwner(ns, key, prev, opts.Author)
+	if err != nil {
+		return err
+	}
+	err = account(ns, key, owner, val)
+	if err != nil {
+		return err
+	}
+	err = db.archive(ns, key, prev, opts.Author)
+	if err != nil {
+		return err
+	}
+	err = ns.Bucket(valueBucket).Put(key, val)
+	if err != nil {
+		return err
+	}
+	err = updateMeta(ns, key, prev, val, opts)
+	if err != nil || (opts.KeepTTL && prev != nil) {
+		return err
+	}
+	return setExpiry(ns, key, opts.TTL)
+}
+
+// deleteValue deletes the key in the namespace if the write options are
+// satisfied.
+func (db DB) deleteValue(ns buckets, key []byte, opts WriteOptions) error {
+	prev := liveValue(ns, key)
+	err := opts.check(prev)
+	if err != nil {
+		return err
+	}
+	err = db.archive(ns, key, prev, opts.Author)
+	if err != nil {
+		return err
+	}
+	return removeKey(ns, key)
+}
+
+// removeKey removes the key and everything stored alongside it, except its
+// history.
+func removeKey(ns buckets, key []byte) error {
+	err := release(ns, key)
+	if err == nil {
+		err = clearExpiry(ns, key)
+	}
+	if err != nil {
+		return err
+	}
+	for _, name := range [][]byte{valueBucket, metaBucket} {
+		err := ns.Bucket(name).Delete(key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (db DB) Delete(key string) (err error) {
+// Put stores the value under key in the namespace if the write options are
+// satisfied, and returns the ETag of the stored value. If not,
+// ErrPreconditionFailed is returned. The namespace is created if it doesn't
+// exist.
+func (db DB) Put(namespaceName, key string, val []byte, opts WriteOptions) (etag string, err error) {
 	err = db.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(valueBucket)
-		return bucket.Delete([]byte(key))
+		ns, err := ensureNamespace(tx, namespaceName)
+		if err != nil {
+			return err
+		}
+		return db.putValue(ns, []byte(key), val, opts)
 	})
+	if err == nil {
+		etag = ETag(val)
+	}
 	return
 }
 
-func (db DB) List(prefixString string) (keys [][]byte, err error) {
-	err = db.View(func(tx *bolt.Tx) error {
-		c := tx.Bucket(valueBucket).Cursor()
-		prefix := []byte(prefixString)
-		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
-			keys = append(keys, copyBytes(k))
+func (db DB) Delete(namespaceName, key string, opts WriteOptions) (err error) {
+	err = db.Update(func(tx *bolt.Tx) error {
+		ns := namespace(tx, namespaceName)
+		if ns == nil {
+			return opts.check(nil)
 		}
-		return nil
+		return db.deleteValue(ns, []byte(key), opts)
 	})
 	return
 }
 
-func EnsureBuckets(db *bolt.DB) {
+// EnsureBuckets creates all buckets that don't exist, along with the root user.
+// Root gets the password rootPass if it is not empty, or otherwise a random
+// password that is logged once and must be changed.
+func EnsureBuckets(db *bolt.DB, rootPass string, h Hasher) {
 	err := db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists(valueBucket)
+		_, err := tx.CreateBucketIfNotExists(namespaceBucket)
+		if err != nil {
+			return err
+		}
+		// Namespaces may be missing buckets added after they were created.
+		var names []string
+		forEachNamespace(tx, func(name string, _ buckets) error {
+			names = append(names, name)
+			return nil
+		})
+		for _, name := range names {
+			ns, err := ensureNamespace(tx, name)
+			if err == nil {
+				err = indexExpiries(ns)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		_, err = tx.CreateBucketIfNotExists(aclBucket)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(groupBucket)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(tokenBucket)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(auditBucket)
 		if err != nil {
 			return err
 		}
@@ -74,12 +284,22 @@ func EnsureBuckets(db *bolt.DB) {
 		if err != nil {
 			return err
 		}
-		rootData := users.Get([]byte(`root`))
-		if rootData == nil {
-			log.Println("Setting up root user (password 'toor', replace it immediately)")
-			err = users.Put([]byte(`root`), DefaultRoot.Marshal())
+		if users.Get([]byte(`root`)) != nil {
+			return nil
 		}
-		return err
+		root := User{Created: time.Now().UTC()}
+		if rootPass == "" {
+			rootPass = base64.RawURLEncoding.EncodeToString(randomBytes(18))
+			root.MustChangePassword = true
+			log.Warnf("Setting up root user with the generated password %s (it is only shown now, and must be changed before root can do anything else)", rootPass)
+		} else {
+			log.Println("Setting up root user with the configured password")
+		}
+		err = h.SetPassword(&root, rootPass)
+		if err != nil {
+			return err
+		}
+		return users.Put([]byte(`root`), root.Marshal())
 	})
 	if err != nil {
 		log.Fatal(err)
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestValsUnsupportedMethod(t *testing.T) {
+	db := newTestDB(t)
+	addTestUser(t, db, "reader", RoleReader)
+	for _, user := range []string{"root", "reader"} {
+		w := serve(db, "PATCH", "/val/key", nil, basicAuth(user))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("PATCH /val/key as %s: expected 404, got %d: %s", user, w.Code, w.Body)
+		}
+	}
+	if w := serve(db, "PUT", "/val/key", nil, basicAuth("reader")); w.Code != http.StatusForbidden {
+		t.Errorf("PUT /val/key as a reader: expected 403, got %d: %s", w.Code, w.Body)
+	}
+}